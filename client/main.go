@@ -11,12 +11,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/paulstuart/websox"
 )
 
@@ -48,17 +48,16 @@ func main() {
 	}
 
 	ctx := context.Background()
-	for {
-		headers, err := websox.Oauth2Header(ctx, uaa_url, uaa_client_id, uaa_client_secret)
-		if err != nil {
-			panic(err)
-		}
-		err = websox.Client(u.String(), gotIt, true, headers, nil)
-		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-			fmt.Printf("(%T) %v\n", err, err)
-		}
-		fmt.Println("sleep for a minute")
-		time.Sleep(time.Minute)
+	headers := func() (http.Header, error) {
+		return websox.Oauth2Header(ctx, uaa_url, uaa_client_id, uaa_client_secret)
+	}
+	// wait a minute between sessions, as well as after failures
+	policy := websox.DefaultReconnect
+	policy.Initial = time.Minute
+	cfg := websox.ClientConfig{Pings: true}
+	if err := cfg.Reconnect(ctx, u.String(), gotIt, headers, policy); err != nil {
+		fmt.Printf("(%T) %v\n", err, err)
+		os.Exit(1)
 	}
 }
 
@@ -0,0 +1,126 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseReason is why the server closed a session,
+// sent to the client as the close code and reason text
+type CloseReason int
+
+// Reasons a session is closed by the server
+const (
+	CloseUnknown          CloseReason = iota // the server gave a close code or text websox does not know
+	CloseProducerFinished                    // the Setup producer closed its channel
+	CloseSessionExpired                      // the session reached its expiration
+	CloseServerShutdown                      // the server is shutting down or the request ended
+	CloseSessionResumed                      // another connection resumed the session
+	CloseAuthRevoked                         // the client's credentials are no longer accepted
+	CloseProtocolError                       // the peer broke the websox protocol
+	ClosePolicyViolation                     // the client broke a server policy
+	CloseServerError                         // the server failed, as with a panic in a callback
+)
+
+var closeReasons = []struct {
+	code int
+	text string
+}{
+	CloseUnknown:          {websocket.CloseNormalClosure, ""},
+	CloseProducerFinished: {websocket.CloseNormalClosure, "producer finished"},
+	CloseSessionExpired:   {websocket.CloseNormalClosure, "session expired"},
+	CloseServerShutdown:   {websocket.CloseGoingAway, "server shutdown"},
+	CloseSessionResumed:   {websocket.CloseGoingAway, errResumed.Error()},
+	CloseAuthRevoked:      {websocket.ClosePolicyViolation, "auth revoked"},
+	CloseProtocolError:    {websocket.CloseProtocolError, "protocol error"},
+	ClosePolicyViolation:  {websocket.ClosePolicyViolation, "policy violation"},
+	CloseServerError:      {websocket.CloseInternalServerErr, "server error"},
+}
+
+// Code returns the RFC 6455 close code sent for the reason
+func (r CloseReason) Code() int {
+	if r < 0 || int(r) >= len(closeReasons) {
+		return websocket.CloseNormalClosure
+	}
+	return closeReasons[r].code
+}
+
+func (r CloseReason) String() string {
+	if r <= 0 || int(r) >= len(closeReasons) {
+		return "unknown"
+	}
+	return closeReasons[r].text
+}
+
+// message returns the close frame payload for the reason,
+// with text replacing the reason's own if given
+func (r CloseReason) message(text string) []byte {
+	if text == "" && r != CloseUnknown {
+		text = r.String()
+	}
+	return websocket.FormatCloseMessage(r.Code(), text)
+}
+
+// CloseError is the error for a session the server closed,
+// other than when its producer finished
+type CloseError struct {
+	Reason CloseReason
+	Code   int    // the RFC 6455 close code
+	Text   string // the reason text sent with the code
+}
+
+func (e *CloseError) Error() string {
+	msg := "websox: session closed by server (" + strconv.Itoa(e.Code)
+	if e.Text != "" {
+		msg += " " + e.Text
+	}
+	return msg + ")"
+}
+
+// Temporary reports whether connecting again may succeed,
+// which is not the case for a client the server refuses
+// or whose session continues on another connection
+func (e *CloseError) Temporary() bool {
+	switch e.Reason {
+	case CloseSessionResumed, CloseAuthRevoked, CloseProtocolError, ClosePolicyViolation:
+		return false
+	}
+	return true
+}
+
+// closeError returns the CloseError for the close frame the server sent,
+// nil for a normal close with no reason or once the producer finished
+func closeError(ce *websocket.CloseError) *CloseError {
+	e := &CloseError{Code: ce.Code, Text: ce.Text}
+	for r, known := range closeReasons {
+		if r != int(CloseUnknown) && known.code == ce.Code && known.text == ce.Text {
+			e.Reason = CloseReason(r)
+			break
+		}
+	}
+	if e.Reason == CloseUnknown {
+		// reason text that is not ours, such as from a proxy, goes by the code
+		switch ce.Code {
+		case websocket.CloseGoingAway:
+			e.Reason = CloseServerShutdown
+		case websocket.CloseProtocolError:
+			e.Reason = CloseProtocolError
+		case websocket.ClosePolicyViolation:
+			e.Reason = ClosePolicyViolation
+		case websocket.CloseInternalServerErr:
+			e.Reason = CloseServerError
+		}
+	}
+	switch {
+	case e.Reason == CloseProducerFinished:
+		return nil
+	case e.Reason == CloseUnknown && e.Code == websocket.CloseNormalClosure && e.Text == "":
+		return nil
+	}
+	return e
+}
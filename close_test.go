@@ -0,0 +1,116 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expired reports whether err is the close of an expired session
+func expired(err error) bool {
+	closed, ok := err.(*CloseError)
+	return ok && closed.Reason == CloseSessionExpired
+}
+
+func TestCloseReasons(t *testing.T) {
+	for r := CloseProducerFinished; r <= CloseServerError; r++ {
+		msg := r.message("")
+		ce := &websocket.CloseError{Code: int(msg[0])<<8 | int(msg[1]), Text: string(msg[2:])}
+		closed := closeError(ce)
+		if r == CloseProducerFinished {
+			if closed != nil {
+				t.Errorf("producer finished gave: %v", closed)
+			}
+			continue
+		}
+		if closed == nil || closed.Reason != r || closed.Code != r.Code() || closed.Text != r.String() {
+			t.Errorf("%s read back as: %+v", r, closed)
+		}
+	}
+
+	for _, tc := range []struct {
+		code   int
+		text   string
+		reason CloseReason
+	}{
+		{websocket.CloseGoingAway, "proxy restarting", CloseServerShutdown},
+		{websocket.CloseInternalServerErr, "panic in Setup", CloseServerError},
+		{websocket.ClosePolicyViolation, "", ClosePolicyViolation},
+		{websocket.CloseMessageTooBig, "", CloseUnknown},
+		{websocket.CloseNormalClosure, "bye", CloseUnknown},
+	} {
+		closed := closeError(&websocket.CloseError{Code: tc.code, Text: tc.text})
+		if closed == nil || closed.Reason != tc.reason {
+			t.Errorf("close %d %q read as: %+v", tc.code, tc.text, closed)
+		}
+	}
+	if closed := closeError(&websocket.CloseError{Code: websocket.CloseNormalClosure}); closed != nil {
+		t.Errorf("normal close gave: %v", closed)
+	}
+}
+
+func TestCloseExpired(t *testing.T) {
+	cfg := PusherConfig{Hub: &Hub{}, Expires: time.Millisecond * 50, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	client := ClientConfig{Logger: FromLogger(logger)}
+	err := client.Client(context.Background(), ts.URL, gotIt)
+	if !expired(err) || err.(*CloseError).Code != websocket.CloseNormalClosure || !err.(*CloseError).Temporary() {
+		t.Fatalf("expected session expired close but got: %v", err)
+	}
+}
+
+// TestCloseRevoked checks that a client closed through the Hub
+// is told why and does not reconnect
+func TestCloseRevoked(t *testing.T) {
+	hub := &Hub{}
+	metrics := endings{ended: make(chan string, 1)}
+	cfg := PusherConfig{Hub: hub, Metrics: metrics, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	var dials int
+	headers := func() (http.Header, error) {
+		dials++
+		return nil, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		client := ClientConfig{Logger: FromLogger(logger)}
+		policy := ReconnectPolicy{Initial: time.Millisecond}
+		done <- client.Reconnect(context.Background(), ts.URL, gotIt, headers, policy)
+	}()
+
+	infos := waitSessions(t, hub, 1)
+	if err := hub.Close(infos[0].ID, CloseAuthRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Close(infos[0].ID+1, CloseAuthRevoked); err != ErrNoSession {
+		t.Errorf("closing a missing session: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		closed, ok := err.(*CloseError)
+		if !ok || closed.Reason != CloseAuthRevoked || closed.Code != websocket.ClosePolicyViolation || closed.Temporary() {
+			t.Errorf("expected auth revoked close but got: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("client did not stop")
+	}
+	if dials != 1 {
+		t.Errorf("expected 1 dial but got: %d", dials)
+	}
+	if reason := <-metrics.ended; reason != EndServerClosed {
+		t.Errorf("session ended with: %q", reason)
+	}
+}
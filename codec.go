@@ -0,0 +1,74 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes the envelopes, Results and typed payloads exchanged on a connection
+//
+// The codec for a connection is negotiated as a websocket subprotocol
+// when the client dials, falling back to JSON if none is agreed upon.
+// MessagePack, CBOR and protocol buffers codecs are in the websoxmsgpack,
+// websoxcbor and websoxproto packages. The websox wire types carry json
+// struct tags, and proto struct tags numbering their fields
+type Codec interface {
+	// Name is the subprotocol used to negotiate the codec
+	Name() string
+
+	// Binary is true if the encoding must be sent as binary messages
+	Binary() bool
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON encodes with encoding/json and is the default codec
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "websox.json" }
+func (jsonCodec) Binary() bool                               { return false }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// frameType returns the websocket message type used for the codec's encoding
+func frameType(codec Codec) int {
+	if codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// subprotocols returns the negotiation names for codecs,
+// ending with JSON if it is not among them so that websox peers
+// always agree on one and can tell legacy peers apart
+func subprotocols(codecs []Codec) []string {
+	names := make([]string, 0, len(codecs)+1)
+	offered := false
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+		offered = offered || codec.Name() == JSON.Name()
+	}
+	if !offered {
+		names = append(names, JSON.Name())
+	}
+	return names
+}
+
+// negotiated returns the codec agreed upon for the connection
+func negotiated(conn *websocket.Conn, codecs []Codec) Codec {
+	protocol := conn.Subprotocol()
+	for _, codec := range codecs {
+		if codec.Name() == protocol {
+			return codec
+		}
+	}
+	return JSON
+}
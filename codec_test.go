@@ -0,0 +1,115 @@
+package websox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// binaryJSON is a JSON codec sent as binary messages, standing in
+// for the codecs of the websoxmsgpack, websoxcbor and websoxproto packages
+type binaryJSON string
+
+func (c binaryJSON) Name() string                             { return string(c) }
+func (binaryJSON) Binary() bool                               { return true }
+func (binaryJSON) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (binaryJSON) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+var (
+	testBinary Codec = binaryJSON("websox.test")
+	testOther  Codec = binaryJSON("websox.other")
+
+	allCodecs = []Codec{JSON, testBinary}
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	raw := json.RawMessage(`"payload"`)
+	for _, codec := range allCodecs {
+		in := Results{ErrMsg: "oops", Payload: &raw, Seq: 42}
+		b, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s results encode error: %v", codec.Name(), err)
+		}
+		var out Results
+		if err := codec.Unmarshal(b, &out); err != nil {
+			t.Fatalf("%s results decode error: %v", codec.Name(), err)
+		}
+		if out.ErrMsg != in.ErrMsg || out.Seq != in.Seq || out.Payload == nil || string(*out.Payload) != string(raw) {
+			t.Errorf("%s results mismatch: %+v", codec.Name(), out)
+		}
+
+		b, err = codec.Marshal(envelope{Seq: 7})
+		if err != nil {
+			t.Fatalf("%s envelope encode error: %v", codec.Name(), err)
+		}
+		var env envelope
+		if err := codec.Unmarshal(b, &env); err != nil {
+			t.Fatalf("%s envelope decode error: %v", codec.Name(), err)
+		}
+		if env.Seq != 7 {
+			t.Errorf("%s envelope seq is: %d", codec.Name(), env.Seq)
+		}
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	tests := []struct {
+		server, client []Codec
+		want           Codec
+	}{
+		{[]Codec{testBinary, JSON}, []Codec{testOther, testBinary}, testBinary},
+		{[]Codec{testOther, testBinary}, []Codec{testBinary, testOther}, testOther},
+		{[]Codec{testBinary}, nil, JSON},
+		{nil, []Codec{testOther}, JSON},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		cfg := PusherConfig{Codecs: test.server, PingFreq: testPing, Logger: FromLogger(logger)}
+		ts := httptest.NewServer(cfg.Pusher(sendX(t, 1)))
+
+		conn, codec, err := connect(ctx, ts.URL, ClientConfig{Codecs: test.client, Logger: FromLogger(logger)}.defaults())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec != test.want {
+			t.Errorf("expected %s but negotiated: %s (%q)", test.want.Name(), codec.Name(), conn.Subprotocol())
+		}
+		if err := client(ctx, conn, codec, gotIt, ClientConfig{Logger: FromLogger(logger)}); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		ts.Close()
+	}
+}
+
+// TestCodecTyped sends JSON encoded values over a binary session
+func TestCodecTyped(t *testing.T) {
+	done := make(chan Result[string], 1)
+	sender := TypedSetup[Stuff, string](func() (chan Stuff, chan Result[string]) {
+		getter := make(chan Stuff)
+		teller := make(chan Result[string])
+		go func() {
+			getter <- Stuff{Msg: "typed", Count: 3, TS: time.Now()}
+			done <- <-teller
+			close(getter)
+		}()
+		return getter, teller
+	})
+	echo := TypedActionable[Stuff, string](func(s Stuff) (string, bool, error) {
+		return s.Msg, true, nil
+	})
+
+	ctx := context.Background()
+	cfg := PusherConfig{Codecs: []Codec{testBinary}, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(sender.SetupCodec(JSON)))
+	defer ts.Close()
+
+	client := ClientConfig{Codecs: []Codec{testBinary}, Logger: FromLogger(logger)}
+	if err := client.Client(ctx, ts.URL, echo.ActionableCodec(JSON)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if result := <-done; result.ErrMsg != "" || result.Value != "typed" || result.Seq != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Compression configures per message compression (permessage-deflate, RFC 7692)
+//
+// Compression is only used if both ends of the connection enable it
+type Compression struct {
+	// Enabled offers compression when connecting
+	Enabled bool
+
+	// Level is the flate compression level (-2 to 9), zero uses the default
+	Level int
+
+	// Threshold is the size in bytes below which messages are sent uncompressed
+	Threshold int
+}
+
+// apply sets the compression level for a connection
+func (c Compression) apply(conn *websocket.Conn) error {
+	if !c.Enabled || c.Level == 0 {
+		return nil
+	}
+	return conn.SetCompressionLevel(c.Level)
+}
+
+// compressed reports whether permessage-deflate was agreed to in the handshake headers
+func compressed(header http.Header) bool {
+	for _, ext := range header.Values("Sec-Websocket-Extensions") {
+		if strings.HasPrefix(strings.TrimSpace(ext), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// sized enables write compression on conn if the message in r meets the threshold,
+// returning a reader that yields the complete message
+func sized(conn *websocket.Conn, threshold int, r io.Reader) (io.Reader, error) {
+	if threshold <= 0 {
+		conn.EnableWriteCompression(true)
+		return r, nil
+	}
+	peek := make([]byte, threshold)
+	n, err := io.ReadFull(r, peek)
+	switch err {
+	case nil:
+		conn.EnableWriteCompression(true)
+		return io.MultiReader(bytes.NewReader(peek), r), nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		conn.EnableWriteCompression(false)
+		return bytes.NewReader(peek[:n]), nil
+	}
+	return nil, err
+}
@@ -0,0 +1,117 @@
+package websox
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// repetitive returns a setup sending one large, highly compressible message
+func repetitive(size int) Setup {
+	return func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			getter <- bytes.NewReader(bytes.Repeat([]byte(`{"msg":"again"}`), size/15))
+			<-teller
+			close(getter)
+		}()
+		return getter, teller
+	}
+}
+
+// countingConn tallies the bytes read from the network
+type countingConn struct {
+	net.Conn
+	count *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	tests := []struct {
+		server, client, want bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, true, false},
+		{false, false, false},
+	}
+	for _, test := range tests {
+		cfg := PusherConfig{Compression: Compression{Enabled: test.server}, PingFreq: testPing, Logger: FromLogger(logger)}
+		ts := httptest.NewServer(cfg.Pusher(repetitive(1024)))
+
+		dialer := websocket.Dialer{EnableCompression: test.client}
+		conn, resp, err := dialer.Dial("ws"+ts.URL[4:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := compressed(resp.Header); got != test.want {
+			t.Errorf("server:%t client:%t -- compressed: %t expected: %t", test.server, test.client, got, test.want)
+		}
+		if err := client(context.Background(), conn, JSON, gotIt, ClientConfig{Logger: FromLogger(logger)}); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		ts.Close()
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	const size = 1 << 15
+
+	received := func(threshold int) int64 {
+		cfg := PusherConfig{
+			Compression: Compression{Enabled: true, Level: 9, Threshold: threshold},
+			PingFreq:    testPing,
+			Logger:      FromLogger(logger),
+		}
+		ts := httptest.NewServer(cfg.Pusher(repetitive(size)))
+		defer ts.Close()
+
+		var count int64
+		dialer := websocket.Dialer{
+			EnableCompression: true,
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				return countingConn{Conn: conn, count: &count}, err
+			},
+		}
+		conn, _, err := dialContext(context.Background(), &dialer, ts.URL, nil, FromLogger(logger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client(context.Background(), conn, JSON, takeX(t, 0, nil), ClientConfig{Logger: FromLogger(logger)}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return atomic.LoadInt64(&count)
+	}
+
+	if n := received(0); n > size/8 {
+		t.Errorf("compressed message used %d bytes", n)
+	}
+	if n := received(size * 2); n < size {
+		t.Errorf("uncompressed message used only %d bytes", n)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	compression := Compression{Enabled: true, Threshold: 64}
+	cfg := PusherConfig{Compression: compression, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 10)))
+	defer ts.Close()
+
+	client := ClientConfig{Compression: compression, Logger: FromLogger(logger)}
+	if err := client.Client(context.Background(), ts.URL, takeX(t, 0, nil)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PusherConfig holds the settings for the sessions served by a Pusher
+//
+// The zero value pushes one message at a time using JSON,
+// with no session expiration, no compression and no pings
+type PusherConfig struct {
+	// Upgrader accepts client connections, nil uses the gorilla/websocket defaults
+	//
+	// Its Subprotocols and EnableCompression fields are replaced
+	// by the values derived from Codecs and Compression.
+	// If it has a CheckOrigin function it is applied after Origins
+	Upgrader *websocket.Upgrader
+
+	// Origins decides which browser origins may connect
+	Origins OriginPolicy
+
+	// Window is the number of messages that may await client replies,
+	// always 1 for clients that negotiate no subprotocol
+	Window int
+
+	// Expires limits the length of a session, zero never expires
+	Expires time.Duration
+
+	// PingFreq is how often the client is pinged, zero never pings
+	//
+	// Pings are sent from their own goroutine, so they keep to time
+	// however busy the session is
+	PingFreq time.Duration
+
+	// MissedPongs ends the session once this many pings in a row go unanswered,
+	// zero keeps pinging regardless
+	//
+	// Anything heard from the client counts as an answer, but a client
+	// only answers pings while it is reading, so this should allow for
+	// the longest its Actionable takes
+	MissedPongs int
+
+	// ReplyTimeout is how long to wait for the reply to a push before
+	// failing it with ErrReplyTimeout, zero waits forever
+	//
+	// A client that negotiates no subprotocol sends replies without
+	// the seq of their push, so its session ends on a reply timeout
+	ReplyTimeout time.Duration
+
+	// MaxMessageSize limits the size of client replies, zero is unlimited
+	MaxMessageSize int64
+
+	// Codecs are offered to clients in order of preference, JSON if empty
+	Codecs []Codec
+
+	// Compression configures per message compression
+	Compression Compression
+
+	// Shutdown ends all sessions when done, in addition to their request contexts
+	Shutdown context.Context
+
+	// Contacted is called whenever a client is heard from,
+	// one call at a time for each session
+	Contacted func()
+
+	// Hub registers each session, so it can be sent messages
+	// in addition to those from its Setup
+	Hub *Hub
+
+	// Metrics records session activity, nil records nothing
+	Metrics Metrics
+
+	// Tracing starts a span for each push that ends with its reply
+	Tracing Tracing
+
+	// Outbox keeps messages from Setup until they are answered,
+	// so they can be redelivered if the connection is lost
+	Outbox *Outbox
+
+	// Requests answers requests sent by clients with a Requester,
+	// they are answered with ErrNoHandler if nil
+	Requests RequestHandler
+
+	// Recovery handles panics in Setup, Contacted and Requests
+	Recovery Recovery
+
+	// ResumeGrace keeps a session whose connection failed for this long,
+	// so a client reconnecting with Resume set continues where it left off,
+	// zero ends sessions with their connections
+	//
+	// Messages from Setup are kept in memory until answered,
+	// and the unanswered ones are replayed when the session is resumed
+	ResumeGrace time.Duration
+
+	// Logger logs session activity, slog.Default() if nil
+	//
+	// Each session logs with its session ID and the client's remote address
+	Logger *slog.Logger
+}
+
+// ClientConfig holds the settings for a Client connection
+type ClientConfig struct {
+	// Dialer connects to the server, nil uses websocket.DefaultDialer
+	//
+	// Its Subprotocols and EnableCompression fields are replaced
+	// by the values derived from Codecs and Compression
+	Dialer *websocket.Dialer
+
+	// Headers supplies optional http headers for authentication
+	Headers http.Header
+
+	// Pings will log websocket pings if set true
+	Pings bool
+
+	// IdleTimeout fails the connection with ErrPeerTimeout if nothing,
+	// including pings and pongs, is heard from the server for this long,
+	// zero waits forever
+	IdleTimeout time.Duration
+
+	// PingFreq is how often the server is pinged, zero never pings
+	PingFreq time.Duration
+
+	// MissedPongs fails the connection with ErrPeerTimeout once this many
+	// pings in a row go unanswered, zero keeps pinging regardless
+	MissedPongs int
+
+	// MaxMessageSize limits the size of server pushes, zero is unlimited
+	MaxMessageSize int64
+
+	// Codecs are offered to the server in order of preference, JSON if empty
+	Codecs []Codec
+
+	// Compression configures per message compression
+	Compression Compression
+
+	// Tracing runs the Actionable for each message in a span
+	// that continues the trace of the push
+	Tracing Tracing
+
+	// Topics are the topic patterns subscribed to when connecting,
+	// for servers that publish through a Hub
+	Topics []string
+
+	// Subscriptions changes the subscribed topics while connected,
+	// the changes are kept for later connections. They are not sent
+	// to servers that negotiate no subprotocol
+	Subscriptions <-chan Subscription
+
+	// subscribed tracks the topics across connections
+	subscribed *topicSet
+
+	// Dedup answers messages redelivered from a server Outbox with
+	// the Results they got before, rather than running the Actionable again
+	Dedup *Dedup
+
+	// Workers handles up to this many messages at once, one at a time if less than 2
+	//
+	// Replies are sent as each message is done, so a slow message does not hold
+	// up the others. Messages already queued are handled before the client returns
+	Workers int
+
+	// Queue limits the messages read ahead of the Workers, Workers if zero
+	Queue int
+
+	// Ordering is the order the Workers handle messages in
+	Ordering Ordering
+
+	// Key returns the key messages are ordered by with OrderByKey,
+	// the topic of the message if nil
+	Key func(r io.Reader) string
+
+	// Requester sends requests to the server while connected
+	Requester *Requester
+
+	// Recovery handles panics in the Actionable and Key
+	Recovery Recovery
+
+	// Resume presents the session token and the offset answered up to
+	// when reconnecting, so a server with ResumeGrace set resumes the session
+	Resume bool
+
+	// resumed tracks the session across connections
+	resumed *resumeState
+
+	// Logger logs client activity, slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// upgrader returns the upgrader for the configured codecs and compression
+func (cfg PusherConfig) upgrader() *websocket.Upgrader {
+	var upgrader websocket.Upgrader
+	if cfg.Upgrader != nil {
+		upgrader = *cfg.Upgrader
+	}
+	upgrader.Subprotocols = subprotocols(cfg.Codecs)
+	upgrader.EnableCompression = cfg.Compression.Enabled
+	if upgrader.CheckOrigin == nil {
+		// Origins has already been applied to the request
+		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+	return &upgrader
+}
+
+// dialer returns the dialer for the configured codecs and compression
+func (cfg ClientConfig) dialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if cfg.Dialer != nil {
+		dialer = *cfg.Dialer
+	}
+	dialer.Subprotocols = subprotocols(cfg.Codecs)
+	dialer.EnableCompression = cfg.Compression.Enabled
+	return &dialer
+}
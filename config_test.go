@@ -0,0 +1,65 @@
+package websox
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPusherConfigUpgrader(t *testing.T) {
+	var checked bool
+	cfg := PusherConfig{
+		Upgrader: &websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				checked = true
+				return false
+			},
+		},
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 1)))
+	defer ts.Close()
+
+	if err := (ClientConfig{Logger: FromLogger(logger)}).Client(context.Background(), ts.URL, gotIt); err == nil {
+		t.Fatal("expected upgrade to be refused")
+	}
+	if !checked {
+		t.Fatal("configured upgrader was not used")
+	}
+}
+
+func TestClientConfigDialer(t *testing.T) {
+	cfg := PusherConfig{
+		Window:   2,
+		Expires:  testExpires,
+		PingFreq: testPing,
+		Codecs:   []Codec{testBinary, JSON},
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 5)))
+	defer ts.Close()
+
+	var dialed bool
+	client := ClientConfig{
+		Dialer: &websocket.Dialer{
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = true
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		Codecs: []Codec{testBinary},
+		Pings:  true,
+		Logger: FromLogger(logger),
+	}
+	if err := client.Client(context.Background(), ts.URL, takeX(t, 0, nil)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !dialed {
+		t.Fatal("configured dialer was not used")
+	}
+}
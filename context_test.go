@@ -0,0 +1,73 @@
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// idler sends a single message and reports when its Results channel is closed
+func idler(closed chan bool) Setup {
+	return func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			getter <- Stuff{Msg: "idler", Count: 1, TS: time.Now()}.NewReader()
+			for range teller {
+			}
+			closed <- true
+		}()
+		return getter, teller
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	closed := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(Pusher(idler(closed), testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := func(r io.Reader) (interface{}, bool, error) {
+		cancel()
+		return nil, true, nil
+	}
+
+	err := ClientContext(ctx, ts.URL, cancelled, true, nil, logger)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("results channel was not closed")
+	}
+}
+
+func TestPusherShutdown(t *testing.T) {
+	closed := make(chan bool, 1)
+	shutdown, cancel := context.WithCancel(context.Background())
+	ts := httptest.NewServer(http.HandlerFunc(PusherContext(shutdown, idler(closed), 1, testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	shutter := func(r io.Reader) (interface{}, bool, error) {
+		cancel()
+		return nil, true, nil
+	}
+
+	err := Client(ts.URL, shutter, true, nil, logger)
+	if closed, ok := err.(*CloseError); !ok || closed.Reason != CloseServerShutdown || closed.Code != websocket.CloseGoingAway {
+		t.Fatalf("expected server shutdown close but got: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("results channel was not closed")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultDedupSize is the number of message IDs a Dedup remembers if not given
+	DefaultDedupSize = 1024
+)
+
+// Dedup remembers the Results of the most recently handled messages by ID,
+// so a message redelivered from a server's Outbox is answered again
+// without running the Actionable
+//
+// The same Dedup should be used for every connection to the server,
+// it is safe for concurrent use
+type Dedup struct {
+	size    int
+	mu      sync.Mutex
+	order   *list.List // most recently handled first
+	entries map[string]*list.Element
+	file    *os.File
+	path    string
+	lines   int // records in file
+}
+
+// handled is the outcome of a message, as remembered by a Dedup
+type handled struct {
+	ID      string `json:"id"`
+	Codec   string `json:"codec"`
+	ErrMsg  string `json:"error,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// NewDedup returns a Dedup that remembers up to size messages,
+// DefaultDedupSize if size is not positive
+//
+// If path is not empty the messages are also kept in that file,
+// so they are remembered across restarts
+func NewDedup(size int, path string) (*Dedup, error) {
+	if size < 1 {
+		size = DefaultDedupSize
+	}
+	d := &Dedup{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		path:    path,
+	}
+	if path == "" {
+		return d, nil
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the records in the file, the last one for an ID wins
+func (d *Dedup) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "dedup open error")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var h handled
+		if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+			// a partial record from a crash is the last one
+			break
+		}
+		d.remember(h)
+	}
+	return errors.Wrap(scanner.Err(), "dedup read error")
+}
+
+// compact rewrites the file with only the remembered records
+func (d *Dedup) compact() error {
+	if d.file != nil {
+		d.file.Close()
+	}
+	tmp := d.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "dedup create error")
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for e := d.order.Back(); e != nil; e = e.Prev() {
+		if err = enc.Encode(e.Value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, d.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "dedup write error")
+	}
+	d.lines = d.order.Len()
+	d.file, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return errors.Wrap(err, "dedup open error")
+}
+
+// remember adds h as the most recent message, forgetting the oldest if full
+func (d *Dedup) remember(h handled) {
+	if e, ok := d.entries[h.ID]; ok {
+		e.Value = h
+		d.order.MoveToFront(e)
+		return
+	}
+	d.entries[h.ID] = d.order.PushFront(h)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(handled).ID)
+	}
+}
+
+// lookup returns the outcome of message id if it was handled before
+func (d *Dedup) lookup(id string) (handled, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[id]
+	if !ok {
+		return handled{}, false
+	}
+	d.order.MoveToFront(e)
+	return e.Value.(handled), true
+}
+
+// add remembers the outcome of a message, writing it to the file if there is one
+func (d *Dedup) add(h handled) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remember(h)
+	if d.file == nil {
+		return nil
+	}
+	if d.lines >= 2*d.size {
+		return d.compact()
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return errors.Wrap(err, "dedup encode error")
+	}
+	if _, err := d.file.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "dedup write error")
+	}
+	d.lines++
+	return nil
+}
+
+// Len returns the number of messages remembered
+func (d *Dedup) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+// Close closes the file the messages are kept in, if any
+func (d *Dedup) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// results returns the remembered Results for a redelivered push,
+// with the payload re-encoded if the connection uses a different codec
+func (h handled) results(seq uint64, codec Codec, codecs []Codec) (Results, error) {
+	results := Results{Seq: seq, ID: h.ID, ErrMsg: h.ErrMsg}
+	if h.Payload == nil {
+		return results, nil
+	}
+	payload := h.Payload
+	if h.Codec != codec.Name() {
+		var from Codec
+		for _, c := range codecs {
+			if c.Name() == h.Codec {
+				from = c
+				break
+			}
+		}
+		if from == nil && h.Codec == JSON.Name() {
+			from = JSON
+		}
+		if from == nil {
+			return results, errors.Errorf("reply was encoded with unknown codec %s", h.Codec)
+		}
+		var v interface{}
+		if err := from.Unmarshal(payload, &v); err != nil {
+			return results, errors.Wrap(err, "reply decode error")
+		}
+		b, err := codec.Marshal(v)
+		if err != nil {
+			return results, errors.Wrap(err, "reply encode error")
+		}
+		payload = b
+	}
+	raw := json.RawMessage(payload)
+	results.Payload = &raw
+	return results, nil
+}
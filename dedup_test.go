@@ -0,0 +1,151 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	d, err := NewDedup(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := d.add(handled{ID: id, Codec: JSON.Name(), Payload: []byte(`"` + id + `"`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := d.lookup("a"); ok {
+		t.Error("oldest message not forgotten")
+	}
+	if _, ok := d.lookup("b"); !ok {
+		t.Error("message b forgotten")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// remembered across restarts
+	if d, err = NewDedup(2, path); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	h, ok := d.lookup("c")
+	if !ok || d.Len() != 2 {
+		t.Fatalf("%d messages remembered after reopening", d.Len())
+	}
+
+	// replayed with the codec of the connection
+	results, err := h.results(7, testBinary, []Codec{testBinary, JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.codec = testBinary
+	var reply string
+	if err := results.Decode(&reply); err != nil || reply != "c" || results.Seq != 7 || results.ID != "c" {
+		t.Errorf("replayed results: %+v %q (%v)", results, reply, err)
+	}
+
+	// the file is kept compact
+	for i := 0; i < 10; i++ {
+		if err := d.add(handled{ID: fmt.Sprint(i), Codec: JSON.Name()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines int
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	if lines > 4 {
+		t.Errorf("dedup file has %d records", lines)
+	}
+}
+
+// TestDedupRedelivery checks that a message handled before the connection dropped
+// is answered again without running the Actionable
+func TestDedupRedelivery(t *testing.T) {
+	dedup, err := NewDedup(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, answered := redelivery(t, ClientConfig{Dedup: dedup})
+	if len(got) != 3 || !strings.HasPrefix(got[1], `"two"@`) || !strings.HasPrefix(got[2], `"three"@`) {
+		t.Errorf("client got: %q", got)
+	}
+	if len(answered) != 2 || dedup.Len() != 3 {
+		t.Errorf("producer got answers for %q, %d messages remembered", answered, dedup.Len())
+	}
+}
+
+// TestDedupEncodeError checks that a reply that cannot be encoded
+// is answered with the encode error, and remembered as such
+func TestDedupEncodeError(t *testing.T) {
+	dedup, err := NewDedup(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []Results)
+	sender := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader, 2)
+		teller := make(chan Results)
+		for i := 0; i < 2; i++ {
+			getter <- Stuff{Msg: "bad", Count: i, TS: time.Now()}.NewReader()
+		}
+		close(getter)
+		go func() {
+			var all []Results
+			for results := range teller {
+				all = append(all, results)
+			}
+			done <- all
+		}()
+		return getter, teller
+	}
+	cfg := PusherConfig{
+		Outbox: &Outbox{Store: NewMemoryStore()},
+		Logger: FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sender))
+	defer ts.Close()
+
+	reply := func(r io.Reader) (interface{}, bool, error) {
+		return badjson{}, true, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := (ClientConfig{Dedup: dedup, Logger: FromLogger(logger)}).Client(ctx, ts.URL, reply); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	all := <-done
+	if len(all) != 2 {
+		t.Fatalf("unexpected results: %+v", all)
+	}
+	for _, results := range all {
+		if !strings.HasPrefix(results.ErrMsg, "reply encode error: ") || results.Payload != nil {
+			t.Errorf("unexpected results: %+v", results)
+		}
+	}
+	h, ok := dedup.lookup(all[0].ID)
+	if all[0].ID == "" || !ok || h.ErrMsg != all[0].ErrMsg {
+		t.Errorf("remembered %+v for %q", h, all[0].ID)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxEnvelope caps the size of a frame envelope to guard against garbage lengths
+	maxEnvelope = 1 << 16
+)
+
+// envelope carries the delivery metadata for a pushed message
+//
+// On the wire each push is a single binary message consisting of
+// the uvarint encoded length of the envelope, the envelope encoded
+// with the connection's Codec, and then the unmodified message payload.
+// Peers that negotiate no subprotocol predate the envelope, and are
+// sent the payload alone, one push at a time, as they always were
+//
+// Trace holds the propagated trace context of the push, if any,
+// Topic the topic it was published to through a Hub,
+// and ID the message ID of a push kept in an Outbox, which stays
+// the same when the message is redelivered
+//
+// Offset is the position of a message from Setup in a resumable session,
+// which the client acknowledges when it reconnects
+//
+// A frame that answers a client request has no Seq, but the ID
+// of the request and the error from its handler, if any
+type envelope struct {
+	Seq     uint64            `json:"seq" proto:"1"`
+	Trace   map[string]string `json:"trace,omitempty" proto:"2"`
+	Topic   string            `json:"topic,omitempty" proto:"3"`
+	ID      string            `json:"id,omitempty" proto:"4"`
+	Request uint64            `json:"request,omitempty" proto:"5"`
+	Error   string            `json:"error,omitempty" proto:"6"`
+	Offset  uint64            `json:"offset,omitempty" proto:"7"`
+}
+
+// upstream is a message from the client, either the Results of a push,
+// a change to the topics it is subscribed to if Subscription is set,
+// or a request to the server if Request is set
+//
+// Results are sent as is, so the fields of a Subscription are simply
+// unknown to websox servers that do not support topics. Servers that
+// negotiate no subprotocol would take any upstream message for the Results
+// of a push, and are only sent Results
+type upstream struct {
+	Results
+	Subscription *Subscription `json:"subscription,omitempty" proto:"5"`
+	Request      *request      `json:"request,omitempty" proto:"7"`
+}
+
+// legacy reports whether the peer on conn predates the envelope,
+// having negotiated no subprotocol
+func legacy(conn *websocket.Conn) bool {
+	return conn.Subprotocol() == ""
+}
+
+// writeFrame sends the envelope followed by the contents of r as one binary message,
+// returning the size of the payload sent
+//
+// Payloads smaller than threshold are sent uncompressed,
+// and legacy peers are sent the payload without the envelope
+func writeFrame(conn *websocket.Conn, codec Codec, threshold int, env envelope, r io.Reader) (int64, error) {
+	var hdr []byte
+	framed := !legacy(conn)
+	if framed {
+		var err error
+		if hdr, err = codec.Marshal(env); err != nil {
+			return 0, errors.Wrap(err, "envelope encode error")
+		}
+	}
+
+	r, err := sized(conn, threshold, r)
+	if err != nil {
+		return 0, errors.Wrap(err, "payload read error")
+	}
+
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return 0, errors.Wrap(err, "writer error")
+	}
+
+	if framed {
+		var size [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(size[:], uint64(len(hdr)))
+		if _, err := w.Write(size[:n]); err != nil {
+			w.Close()
+			return 0, errors.Wrap(err, "envelope write error")
+		}
+		if _, err := w.Write(hdr); err != nil {
+			w.Close()
+			return 0, errors.Wrap(err, "envelope write error")
+		}
+	}
+	sent, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return sent, errors.Wrap(err, "copy error")
+	}
+	return sent, errors.Wrap(w.Close(), "close error")
+}
+
+// readFrame splits a binary message into its envelope and a reader for the payload
+func readFrame(codec Codec, r io.Reader) (envelope, io.Reader, error) {
+	var env envelope
+	br := bufio.NewReader(r)
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return env, nil, errors.Wrap(err, "envelope size error")
+	}
+	if size > maxEnvelope {
+		return env, nil, errors.Errorf("envelope size %d exceeds limit of %d", size, maxEnvelope)
+	}
+	hdr := make([]byte, size)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return env, nil, errors.Wrap(err, "envelope read error")
+	}
+	if err := codec.Unmarshal(hdr, &env); err != nil {
+		return env, nil, errors.Wrap(err, "envelope decode error")
+	}
+	return env, br, nil
+}
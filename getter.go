@@ -7,17 +7,28 @@
 package websox
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
+const (
+	// maxErrorBody limits how much of a failed handshake response is logged
+	maxErrorBody = 512
+)
+
 // Actionable functions process an io.Reader and returns
 // any relevant results
 // a bool set false if to close the client,
@@ -29,124 +40,512 @@ type Actionable func(io.Reader) (interface{}, bool, error)
 // pings will log websocket pings if set true
 // headers supplies optional http headers for authentication
 // logger logs actions
+//
+// ClientConfig.Client offers the other options.
+// It returns nil once the server's producer is done,
+// and a *CloseError if the server closed the session for any other reason
 func Client(url string, fn Actionable, pings bool, headers http.Header, logger *log.Logger) error {
-	if logger == nil {
-		logger = log.New(os.Stderr, "client ", LogFlags)
-	}
-	conn, err := dial(url, headers, logger)
+	return ClientContext(context.Background(), url, fn, pings, headers, logger)
+}
+
+// ClientContext is a Client that runs until ctx is done
+//
+// The codecs are offered to the server in order of preference,
+// only JSON is supported if none are given
+func ClientContext(ctx context.Context, url string, fn Actionable, pings bool, headers http.Header, logger *log.Logger, codecs ...Codec) error {
+	return ClientConfig{Headers: headers, Pings: pings, Codecs: codecs, Logger: FromLogger(logger)}.Client(ctx, url, fn)
+}
+
+// Client connects to url and applies fn to each message received,
+// as configured, until the session ends or ctx is done
+//
+// On cancellation a close frame is sent to the server
+// and ctx.Err() is returned once the connection is shut down
+func (cfg ClientConfig) Client(ctx context.Context, url string, fn Actionable) error {
+	cfg = cfg.defaults()
+	conn, codec, err := connect(ctx, url, cfg)
 	if err != nil {
 		return err
 	}
+	return client(ctx, conn, codec, fn, cfg)
+}
 
-	if pings {
-		pingHandler := conn.PingHandler()
-		conn.SetPingHandler(func(s string) error {
-			logger.Print("GOT A PING:", s)
-			return pingHandler(s)
-		})
+// defaults fills in the unset fields of the config
+func (cfg ClientConfig) defaults() ClientConfig {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if len(cfg.Codecs) == 0 {
+		cfg.Codecs = []Codec{JSON}
 	}
+	if cfg.subscribed == nil {
+		cfg.subscribed = newTopicSet(cfg.Topics)
+	}
+	if cfg.Resume && cfg.resumed == nil {
+		cfg.resumed = &resumeState{}
+	}
+	return cfg
+}
 
-	return client(conn, fn, logger)
+// connect dials url, returning the connection and the codec negotiated for it
+func connect(ctx context.Context, url string, cfg ClientConfig) (*websocket.Conn, Codec, error) {
+	logger := cfg.Logger
+	headers := cfg.resumed.header(cfg.subscribed.header(cfg.Headers))
+	conn, resp, err := dialContext(ctx, cfg.dialer(), url, headers, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.resumed.connected(resp.Header.Get(sessionHeader)) {
+		logger.Info("session resumed", "offset", headers.Get(offsetHeader))
+	}
+	if err := cfg.Compression.apply(conn); err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "compression level error")
+	}
+	if cfg.MaxMessageSize > 0 {
+		conn.SetReadLimit(cfg.MaxMessageSize)
+	}
+	return conn, negotiated(conn, cfg.Codecs), nil
 }
 
 // client applies the Actionable function to the websocket connection
-func client(conn *websocket.Conn, fn Actionable, logger *log.Logger) error {
+func client(ctx context.Context, conn *websocket.Conn, codec Codec, fn Actionable, cfg ClientConfig) error {
+	logger := cfg.Logger
+	started := time.Now()
+	var received, size atomic.Int64
+
+	// WriteControl is safe to call concurrently with the client loop,
+	// so the close frame can go out while we wait on the server
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Info("client cancelled", "error", ctx.Err())
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "client cancelled")
+			deadline := time.Now().Add(writeWait)
+			if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+				logger.Debug("close message not sent", "error", err)
+			}
+			// don't wait forever on a server that never answers
+			conn.UnderlyingConn().SetReadDeadline(deadline)
+		case <-stop:
+		}
+	}()
+
+	// the server is pinged throughout if configured, and anything heard from it,
+	// including its own pings, shows it is still there
+	pings := startKeepalive(conn, cfg.PingFreq, cfg.MissedPongs)
+	defer pings.stop()
+	var lost atomic.Bool
+	if pings != nil {
+		go func() {
+			select {
+			case err := <-pings.dead():
+				if err != ErrPeerTimeout {
+					// reading fails too with the connection
+					logger.Warn("ping failed", "error", err)
+					return
+				}
+				lost.Store(true)
+				// wake the reader
+				conn.SetReadDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+	}
+	heard := func() {
+		pings.alive()
+		// the idle clock restarts
+		if cfg.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+		}
+	}
+	pingHandler := conn.PingHandler()
+	conn.SetPingHandler(func(s string) error {
+		if cfg.Pings {
+			logger.Info("ping received", "data", s)
+		}
+		heard()
+		return pingHandler(s)
+	})
+	conn.SetPongHandler(func(string) error {
+		heard()
+		return nil
+	})
+
+	// subscription changes are written alongside results,
+	// so writes to conn are serialized
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.EnableWriteCompression(len(b) >= cfg.Compression.Threshold)
+		return conn.WriteMessage(frameType(codec), b)
+	}
+	if cfg.Subscriptions != nil {
+		go func() {
+			for {
+				select {
+				case sub, ok := <-cfg.Subscriptions:
+					if !ok {
+						return
+					}
+					cfg.subscribed.apply(sub)
+					if legacy(conn) {
+						// the server would take it for the Results of a push
+						logger.Debug("subscription kept for later connections, the server predates topics")
+						continue
+					}
+					b, err := codec.Marshal(upstream{Subscription: &sub})
+					if err != nil {
+						logger.Error("subscription encode failed", "error", err)
+						continue
+					}
+					if err := write(b); err != nil {
+						logger.Warn("subscription write failed", "error", err)
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	// requests sent await their answers, until the connection closes
+	var (
+		rmu      sync.Mutex
+		lastID   uint64
+		awaiting = make(map[uint64]chan outcome)
+	)
+	if cfg.Requester != nil {
+		go func() {
+			for {
+				select {
+				case req := <-cfg.Requester.out:
+					if legacy(conn) {
+						// the server would take it for the Results of a push
+						req.reply <- outcome{err: ErrNoHandler}
+						continue
+					}
+					rmu.Lock()
+					if awaiting == nil {
+						rmu.Unlock()
+						req.reply <- outcome{err: ErrSessionClosed}
+						return
+					}
+					lastID++
+					id := lastID
+					awaiting[id] = req.reply
+					rmu.Unlock()
+
+					b, err := codec.Marshal(upstream{Request: &request{ID: id, Payload: req.payload}})
+					if err == nil {
+						err = write(b)
+					}
+					if err != nil {
+						logger.Warn("request failed", "request", id, "error", err)
+						rmu.Lock()
+						delete(awaiting, id)
+						rmu.Unlock()
+						req.reply <- outcome{err: errors.Wrap(err, "request write error")}
+						continue
+					}
+					logger.Debug("request sent", "request", id, "bytes", len(req.payload))
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		rmu.Lock()
+		defer rmu.Unlock()
+		for _, reply := range awaiting {
+			reply <- outcome{err: ErrSessionClosed}
+		}
+		awaiting = nil
+	}()
 
+	// a server that breaks the protocol is told so
+	closing := CloseUnknown
 	defer func() {
 		// To cleanly close a connection, a client should send a close
 		// frame and wait for the server to close the connection.
-		logger.Println("cleaning up and closing")
-		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-		err := conn.WriteMessage(websocket.CloseMessage, msg)
+		wmu.Lock()
+		err := conn.WriteMessage(websocket.CloseMessage, closing.message(""))
+		wmu.Unlock()
 		if err != nil && websocket.IsUnexpectedCloseError(err, 1000) {
-			logger.Println("websocket CloseMessage error:", err)
+			logger.Debug("close message not sent", "error", err)
 		}
 		conn.Close()
+		logger.Info("connection closed", "received", received.Load(), "bytes", size.Load(), "duration", time.Since(started))
 	}()
 
+	// respond sends the Results for a message
+	respond := func(results Results) error {
+		b, err := codec.Marshal(results)
+		if err != nil {
+			logger.Error("results encode failed", "seq", results.Seq, "error", err)
+			return errors.Wrap(err, "status encode error")
+		}
+		if err := write(b); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warn("results write failed", "seq", results.Seq, "error", err)
+			return errors.Wrap(err, "status write error")
+		}
+		return nil
+	}
+
+	// handle runs fn on a message and sends its Results,
+	// reporting whether fn wants more messages
+	handle := func(env envelope, body io.Reader) (bool, error) {
+		began := time.Now()
+		actx, span := cfg.Tracing.startAction(ctx, env)
+		payload := &countReader{r: body}
+		var (
+			reply interface{}
+			ok    bool
+			err   error
+		)
+		perr := cfg.Recovery.catch("Actionable", logger, func() {
+			reply, ok, err = fn(contextReader{Reader: payload, ctx: actx, topic: env.Topic, id: env.ID})
+		})
+		if perr != nil {
+			ok, err = !cfg.Recovery.Close, perr
+		}
+		status := endAction(span, err)
+		logger.Debug("message handled",
+			"seq", env.Seq,
+			"bytes", payload.n,
+			"elapsed", time.Since(began),
+			"continue", ok,
+			"error", err,
+		)
+		received.Add(1)
+		size.Add(payload.n)
+
+		results := Results{Seq: env.Seq, Span: status, ID: env.ID}
+		if err != nil {
+			results.ErrMsg = err.Error()
+		}
+
+		if reply != nil {
+			b, err := codec.Marshal(reply)
+			if err != nil {
+				// the push is still answered, or it would stay in flight
+				logger.Warn("reply encode failed", "seq", env.Seq, "error", err)
+				results.ErrMsg = "reply encode error: " + err.Error()
+			} else {
+				raw := json.RawMessage(b)
+				results.Payload = &raw
+			}
+		}
+
+		if cfg.Dedup != nil && env.ID != "" {
+			h := handled{ID: env.ID, Codec: codec.Name(), ErrMsg: results.ErrMsg}
+			if results.Payload != nil {
+				h.Payload = *results.Payload
+			}
+			if err := cfg.Dedup.add(h); err != nil {
+				logger.Warn("dedup failed", "id", env.ID, "error", err)
+			}
+		}
+
+		if err := respond(results); err != nil {
+			return ok, err
+		}
+		cfg.resumed.ack(env.Offset)
+		if perr != nil && cfg.Recovery.Close {
+			return false, perr
+		}
+		return ok, nil
+	}
+
+	// with workers, reading stops once a worker's Actionable is done
+	var (
+		pool     *workers
+		stopping atomic.Bool
+		panicked atomic.Pointer[PanicError]
+	)
+	// stopped is the error returned once the workers stop reading
+	stopped := func() error {
+		if perr := panicked.Load(); perr != nil {
+			return perr
+		}
+		return nil
+	}
+	if cfg.Workers > 1 {
+		pool = startWorkers(cfg, func(j job) {
+			more, err := handle(j.env, bytes.NewReader(j.body))
+			if perr, ok := err.(*PanicError); ok {
+				panicked.CompareAndSwap(nil, perr)
+			}
+			if !more && stopping.CompareAndSwap(false, true) {
+				// wake the reader
+				conn.SetReadDeadline(time.Now())
+			}
+		})
+		// queued messages are handled before the close frame is sent
+		defer pool.stop()
+		logger.Debug("workers started", "workers", cfg.Workers, "ordering", cfg.Ordering)
+	}
+
 	var err error
 
 	for ok := true; ok; {
-		logger.Println("client waiting for message")
+		if cfg.IdleTimeout > 0 && ctx.Err() == nil {
+			conn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+		}
+		if stopping.Load() {
+			return stopped()
+		}
+		if lost.Load() {
+			logger.Warn("server stopped answering pings", "missed", cfg.MissedPongs)
+			return ErrPeerTimeout
+		}
 		messageType, r, err := conn.NextReader()
 		if err != nil {
-			if err != nil && websocket.IsCloseError(err, 1000) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if stopping.Load() {
+				return stopped()
+			}
+			if lost.Load() {
+				logger.Warn("server stopped answering pings", "missed", cfg.MissedPongs)
+				return ErrPeerTimeout
+			}
+			if ce, ok := err.(*websocket.CloseError); ok {
+				if closed := closeError(ce); closed != nil {
+					logger.Info("server closed session", "reason", closed.Reason, "code", closed.Code, "text", closed.Text)
+					return closed
+				}
 				return nil
 			}
-			logger.Println("NextReader error:", err)
+			if e, ok := errors.Cause(err).(net.Error); ok && e.Timeout() && cfg.IdleTimeout > 0 {
+				logger.Warn("server idle", "timeout", cfg.IdleTimeout)
+				return ErrPeerTimeout
+			}
+			logger.Warn("read failed", "error", err)
 			return err
 		}
-
-		switch messageType {
-		case websocket.CloseMessage:
-			logger.Println("uhoh! closing time!")
-			break
-		case websocket.PingMessage:
-			logger.Println("PING!")
-			continue
-		case websocket.PongMessage:
-			logger.Println("PONG!")
-			continue
-		}
+		pings.alive()
 
 		if messageType != websocket.BinaryMessage {
-			logger.Printf("UNKNOWN MSG (%T):", messageType)
-			io.Copy(os.Stdout, r)
+			logger.Warn("unexpected message type", "type", messageType)
 			continue
 		}
 
-		var reply interface{}
-		reply, ok, err = fn(r)
-		if err != nil {
-			logger.Println("client function ok:", ok, "err:", err)
+		env, body := envelope{}, r
+		if !legacy(conn) {
+			env, body, err = readFrame(codec, r)
 		}
-
-		var results Results
 		if err != nil {
-			results.ErrMsg = err.Error()
+			logger.Warn("frame error", "error", err)
+			closing = CloseProtocolError
+			return err
 		}
 
-		if reply != nil {
-			b, err := json.Marshal(reply)
+		if env.Request != 0 {
+			b, err := io.ReadAll(body)
 			if err != nil {
-				logger.Println("reply json error:", err)
+				logger.Warn("answer read failed", "request", env.Request, "error", err)
+				return errors.Wrap(err, "answer read error")
+			}
+			rmu.Lock()
+			reply, found := awaiting[env.Request]
+			delete(awaiting, env.Request)
+			rmu.Unlock()
+			if !found {
+				logger.Warn("answer for unknown request", "request", env.Request)
 				continue
 			}
-			raw := json.RawMessage(b)
-			results.Payload = &raw
+			logger.Debug("answer received", "request", env.Request, "bytes", len(b), "error", env.Error)
+			results := Results{Seq: env.Request, ErrMsg: env.Error, codec: codec}
+			if len(b) > 0 {
+				raw := json.RawMessage(b)
+				results.Payload = &raw
+			}
+			reply <- outcome{results: results}
+			continue
 		}
 
-		if err := conn.WriteJSON(results); err != nil {
-			logger.Println("results status json error:", err)
-			return errors.Wrap(err, "status write error")
+		// a redelivered message is answered as it was the first time
+		if cfg.Dedup != nil && env.ID != "" {
+			if h, seen := cfg.Dedup.lookup(env.ID); seen {
+				results, err := h.results(env.Seq, codec, cfg.Codecs)
+				if err == nil {
+					logger.Debug("duplicate message", "seq", env.Seq, "id", env.ID)
+					if err := respond(results); err != nil {
+						return err
+					}
+					cfg.resumed.ack(env.Offset)
+					continue
+				}
+				logger.Warn("duplicate message handled again", "seq", env.Seq, "id", env.ID, "error", err)
+			}
 		}
 
+		if pool != nil {
+			b, err := io.ReadAll(body)
+			if err != nil {
+				logger.Warn("message read failed", "seq", env.Seq, "error", err)
+				return errors.Wrap(err, "message read error")
+			}
+			// pongs wait while the workers are too busy to take the message
+			pings.hold()
+			err = pool.queue(ctx, job{env: env, body: b})
+			pings.release()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// pongs wait while the message is handled
+		pings.hold()
+		ok, err = handle(env, body)
+		pings.release()
+		if err != nil {
+			return err
+		}
 	}
-	logger.Println("client returning error:", err)
 	return err
 }
 
 // dial connects to url and return a websocket connection if successful
 func dial(url string, headers http.Header, logger *log.Logger) (*websocket.Conn, error) {
+	conn, _, err := dialContext(context.Background(), ClientConfig{}.dialer(), url, headers, FromLogger(logger))
+	return conn, err
+}
+
+// dialContext is dial using dialer that gives up when ctx is done,
+// also returning the handshake response
+func dialContext(ctx context.Context, dialer *websocket.Dialer, url string, headers http.Header, logger *slog.Logger) (*websocket.Conn, *http.Response, error) {
 	if logger == nil {
-		logger = log.New(os.Stderr, "client ", LogFlags)
+		logger = slog.Default()
 	}
 	if strings.HasPrefix(url, "http") {
 		url = "ws" + url[4:]
 	}
-	logger.Println("connecting to:", url)
-	conn, resp, err := websocket.DefaultDialer.Dial(url, headers)
+	logger.Debug("connecting", "url", url)
+	conn, resp, err := dialer.DialContext(ctx, url, headers)
 	if err != nil {
 		if resp != nil {
 			if resp.Body != nil {
-				io.Copy(os.Stderr, resp.Body)
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+				logger.Warn("dial refused", "url", url, "status", resp.StatusCode, "body", string(body))
 			}
-			return nil, errors.Wrapf(err, "dial code:%d status:%s", resp.StatusCode, resp.Status)
+			return nil, nil, errors.Wrapf(err, "dial code:%d status:%s", resp.StatusCode, resp.Status)
 		}
-		return nil, errors.Wrap(err, "websocket dial error for url: "+url)
+		return nil, nil, errors.Wrap(err, "websocket dial error for url: "+url)
 	}
 
-	logger.Println("connected")
+	logger.Info("connected", "url", url, "protocol", conn.Subprotocol())
 
-	return conn, nil
+	return conn, resp, nil
 }
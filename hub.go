@@ -0,0 +1,332 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNoSession is returned when sending to a session the Hub does not have
+	ErrNoSession = errors.New("websox: no such session")
+
+	// ErrSessionClosed is returned when a session ends before a message can be sent to it,
+	// and is reported in the Results of a message that it ends without answering
+	ErrSessionClosed = errors.New("websox: session closed")
+)
+
+// Hub tracks the live sessions of the Pushers registered with it,
+// so messages can be sent to a session, a group of sessions, or all of them
+//
+// The zero value is ready to use
+type Hub struct {
+	// Identify returns the authenticated subject of a connecting client
+	// and the groups its session starts in, optional
+	Identify func(r *http.Request) (subject string, groups []string)
+
+	// CallTimeout limits a Call whose context has no deadline,
+	// zero leaves it to the context
+	CallTimeout time.Duration
+
+	mu       sync.RWMutex
+	sessions map[uint64]*Session
+	stats    map[string]*TopicStats
+}
+
+// SessionInfo describes a session in a Hub
+type SessionInfo struct {
+	ID          uint64
+	RemoteAddr  string
+	Subject     string
+	Groups      []string
+	Topics      []string
+	Connected   time.Time
+	LastContact time.Time
+}
+
+// Session is a client connection registered with a Hub
+type Session struct {
+	hub       *Hub
+	id        uint64
+	remote    string
+	subject   string
+	connected time.Time
+	contact   atomic.Int64        // unix nanoseconds of last contact
+	groups    map[string]struct{} // guarded by hub.mu
+	topics    map[string]struct{} // guarded by hub.mu
+	calls     atomic.Uint64       // the last JSON-RPC call ID
+
+	in     chan delivery
+	cancel context.CancelCauseFunc // ends the session with the cause
+	done   chan struct{}
+}
+
+// delivery is a message sent through the Hub, and where its reply goes
+type delivery struct {
+	ctx   context.Context
+	topic string
+	msg   []byte
+	reply chan Results // buffered so the session never waits on the sender
+}
+
+// Report collects the Results of a message sent to several sessions
+type Report struct {
+	// Results holds the reply of each session, by session ID
+	//
+	// Sessions that could not be reached have an ErrMsg saying why
+	Results map[uint64]Results
+
+	// Failed is the number of sessions whose Results have an ErrMsg
+	Failed int
+}
+
+// register adds a session for the request to the hub
+func (h *Hub) register(id uint64, r *http.Request, cancel context.CancelCauseFunc) *Session {
+	s := &Session{
+		hub:       h,
+		id:        id,
+		remote:    r.RemoteAddr,
+		connected: time.Now(),
+		groups:    make(map[string]struct{}),
+		topics:    make(map[string]struct{}),
+		in:        make(chan delivery),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	s.touch()
+
+	var groups []string
+	if h.Identify != nil {
+		s.subject, groups = h.Identify(r)
+	}
+	for _, group := range groups {
+		s.groups[group] = struct{}{}
+	}
+	for _, pattern := range parseTopics(r.Header.Get(topicsHeader)) {
+		s.topics[pattern] = struct{}{}
+	}
+
+	h.mu.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[uint64]*Session)
+	}
+	h.sessions[id] = s
+	h.mu.Unlock()
+	return s
+}
+
+// unregister removes a finished session from the hub
+func (h *Hub) unregister(s *Session) {
+	h.mu.Lock()
+	delete(h.sessions, s.id)
+	h.mu.Unlock()
+	close(s.done)
+}
+
+// Session returns the live session with the given ID
+func (h *Hub) Session(id uint64) (*Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s, ok := h.sessions[id]
+	return s, ok
+}
+
+// Sessions describes all live sessions, ordered by ID
+func (h *Hub) Sessions() []SessionInfo {
+	h.mu.RLock()
+	infos := make([]SessionInfo, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		infos = append(infos, s.info())
+	}
+	h.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Join adds a session to groups
+func (h *Hub) Join(id uint64, groups ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	for _, group := range groups {
+		s.groups[group] = struct{}{}
+	}
+	return nil
+}
+
+// Leave removes a session from groups
+func (h *Hub) Leave(id uint64, groups ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	for _, group := range groups {
+		delete(s.groups, group)
+	}
+	return nil
+}
+
+// Close ends the session with the given ID, telling the client why
+func (h *Hub) Close(id uint64, reason CloseReason) error {
+	s, ok := h.Session(id)
+	if !ok {
+		return ErrNoSession
+	}
+	s.Close(reason)
+	return nil
+}
+
+// Send pushes msg to the session with the given ID and waits for its reply
+func (h *Hub) Send(ctx context.Context, id uint64, msg []byte) (Results, error) {
+	s, ok := h.Session(id)
+	if !ok {
+		return Results{}, ErrNoSession
+	}
+	return s.Send(ctx, msg)
+}
+
+// SendGroup pushes msg to every session in group and waits for their replies
+func (h *Hub) SendGroup(ctx context.Context, group string, msg []byte) Report {
+	return h.sendAll(ctx, "", msg, func(s *Session) bool {
+		_, ok := s.groups[group]
+		return ok
+	})
+}
+
+// Broadcast pushes msg to every session and waits for their replies
+func (h *Hub) Broadcast(ctx context.Context, msg []byte) Report {
+	return h.sendAll(ctx, "", msg, func(*Session) bool { return true })
+}
+
+// sendAll sends msg to the sessions chosen by match, collecting their replies
+//
+// match is called with hub.mu held
+func (h *Hub) sendAll(ctx context.Context, topic string, msg []byte, match func(*Session) bool) Report {
+	h.mu.RLock()
+	var targets []*Session
+	for _, s := range h.sessions {
+		if match(s) {
+			targets = append(targets, s)
+		}
+	}
+	h.mu.RUnlock()
+
+	type reply struct {
+		id      uint64
+		results Results
+	}
+	replies := make(chan reply, len(targets))
+	for _, s := range targets {
+		go func(s *Session) {
+			results, err := s.send(ctx, topic, msg)
+			if err != nil {
+				results = Results{ErrMsg: err.Error()}
+			}
+			replies <- reply{s.id, results}
+		}(s)
+	}
+
+	report := Report{Results: make(map[uint64]Results, len(targets))}
+	for range targets {
+		r := <-replies
+		report.Results[r.id] = r.results
+		if r.results.ErrMsg != "" {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// ID returns the session ID, as logged by the Pusher
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Info describes the session
+func (s *Session) Info() SessionInfo {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	return s.info()
+}
+
+// info describes the session, the caller must hold hub.mu
+func (s *Session) info() SessionInfo {
+	return SessionInfo{
+		ID:          s.id,
+		RemoteAddr:  s.remote,
+		Subject:     s.subject,
+		Groups:      sortedKeys(s.groups),
+		Topics:      sortedKeys(s.topics),
+		Connected:   s.connected,
+		LastContact: time.Unix(0, s.contact.Load()),
+	}
+}
+
+// Done is closed when the session ends
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends the session, telling the client why with the reason's close code and text
+//
+// Messages awaiting replies are failed as when the session ends any other way
+func (s *Session) Close(reason CloseReason) {
+	s.cancel(&CloseError{Reason: reason, Code: reason.Code(), Text: reason.String()})
+}
+
+// Send pushes msg to the session and waits for its reply
+//
+// The message is pushed alongside those from the session's Setup,
+// within the same window of unanswered messages.
+// As with Setup, failures to get a reply are reported in the Results
+func (s *Session) Send(ctx context.Context, msg []byte) (Results, error) {
+	return s.send(ctx, "", msg)
+}
+
+// send pushes msg, published to topic if not empty, and waits for its reply
+func (s *Session) send(ctx context.Context, topic string, msg []byte) (Results, error) {
+	d := delivery{ctx: ctx, topic: topic, msg: msg, reply: make(chan Results, 1)}
+	select {
+	case s.in <- d:
+	case <-s.done:
+		return Results{}, ErrSessionClosed
+	case <-ctx.Done():
+		return Results{}, ctx.Err()
+	}
+	// the session replies to every delivery it takes, even if it ends first
+	select {
+	case results := <-d.reply:
+		return results, nil
+	case <-ctx.Done():
+		return Results{}, ctx.Err()
+	}
+}
+
+// sortedKeys returns the members of a set in order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// touch records contact with the client
+func (s *Session) touch() {
+	s.contact.Store(time.Now().UnixNano())
+}
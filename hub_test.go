@@ -0,0 +1,183 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namedClient replies to every message with its name
+func namedClient(ctx context.Context, url, name, groups string) <-chan error {
+	headers := http.Header{"X-Subject": {name}, "X-Groups": {groups}}
+	cfg := ClientConfig{Headers: headers, Logger: FromLogger(logger)}
+	named := func(r io.Reader) (interface{}, bool, error) {
+		io.Copy(io.Discard, r)
+		return name, true, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.Client(ctx, url, named)
+	}()
+	return done
+}
+
+// waitSessions waits until the hub has count sessions
+func waitSessions(t *testing.T, hub *Hub, count int) []SessionInfo {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		infos := hub.Sessions()
+		if len(infos) == count {
+			return infos
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d sessions -- expected %d", len(infos), count)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := &Hub{
+		Identify: func(r *http.Request) (string, []string) {
+			return r.Header.Get("X-Subject"), strings.Fields(r.Header.Get("X-Groups"))
+		},
+	}
+	cfg := PusherConfig{
+		Hub:      hub,
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clients := []<-chan error{
+		namedClient(ctx, ts.URL, "alice", "blue"),
+		namedClient(ctx, ts.URL, "bob", "blue green"),
+		namedClient(ctx, ts.URL, "carol", ""),
+	}
+	infos := waitSessions(t, hub, len(clients))
+
+	ids := make(map[string]uint64)
+	for _, info := range infos {
+		ids[info.Subject] = info.ID
+		if info.Connected.IsZero() || info.LastContact.Before(info.Connected) {
+			t.Errorf("bad session times: %+v", info)
+		}
+		if got := strings.Join(info.Groups, " "); info.Subject == "bob" && got != "blue green" {
+			t.Errorf("bob is in groups %q", got)
+		}
+	}
+
+	replies := func(report Report) map[string]bool {
+		if report.Failed > 0 {
+			t.Errorf("failed sends: %+v", report.Results)
+		}
+		names := make(map[string]bool)
+		for id, results := range report.Results {
+			var name string
+			if err := results.Decode(&name); err != nil {
+				t.Fatal(err)
+			}
+			if ids[name] != id {
+				t.Errorf("session %d replied as %s", id, name)
+			}
+			names[name] = true
+		}
+		return names
+	}
+
+	if got := replies(hub.Broadcast(ctx, []byte(`"everyone"`))); len(got) != 3 {
+		t.Errorf("broadcast reached: %v", got)
+	}
+	if got := replies(hub.SendGroup(ctx, "blue", []byte(`"blue"`))); len(got) != 2 || !got["alice"] || !got["bob"] {
+		t.Errorf("blue group reached: %v", got)
+	}
+
+	if err := hub.Join(ids["carol"], "green"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Leave(ids["bob"], "green"); err != nil {
+		t.Fatal(err)
+	}
+	if got := replies(hub.SendGroup(ctx, "green", []byte(`"green"`))); len(got) != 1 || !got["carol"] {
+		t.Errorf("green group reached: %v", got)
+	}
+
+	results, err := hub.Send(ctx, ids["bob"], []byte(`"just bob"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := results.Decode(&name); err != nil || name != "bob" {
+		t.Errorf("targeted send answered by %q (%v)", name, err)
+	}
+
+	if _, err := hub.Send(ctx, 0, nil); err != ErrNoSession {
+		t.Errorf("unexpected error for unknown session: %v", err)
+	}
+	if err := hub.Join(0, "blue"); err != ErrNoSession {
+		t.Errorf("unexpected error for unknown session: %v", err)
+	}
+
+	cancel()
+	for _, done := range clients {
+		<-done
+	}
+	waitSessions(t, hub, 0)
+}
+
+// TestHubWithSetup sends through the hub while the Setup producer is also pushing
+func TestHubWithSetup(t *testing.T) {
+	hub := &Hub{}
+	cfg := PusherConfig{
+		Hub:      hub,
+		Window:   2,
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+
+	// the producer holds the session open until the hub message is answered
+	hubbed := make(chan struct{})
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			defer close(getter)
+			getter <- Stuff{Msg: "from setup"}.NewReader()
+			if results := <-teller; results.ErrMsg != "" {
+				t.Error("setup push failed:", results.ErrMsg)
+			}
+			<-hubbed
+		}()
+		return getter, teller
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	done := namedClient(context.Background(), ts.URL, "dave", "")
+	infos := waitSessions(t, hub, 1)
+
+	results, err := hub.Send(context.Background(), infos[0].ID, []byte(`"from hub"`))
+	close(hubbed)
+	if err != nil || results.ErrMsg != "" {
+		t.Fatalf("hub send failed: %v %s", err, results.ErrMsg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the session is gone once its producer is done
+	waitSessions(t, hub, 0)
+	if _, err := hub.Send(context.Background(), infos[0].ID, nil); err != ErrNoSession {
+		t.Errorf("unexpected error after session ended: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrPeerTimeout is the error for a peer that stopped answering pings,
+// or was not heard from within the client's IdleTimeout
+//
+// It is a net.Error whose Timeout method reports true
+var ErrPeerTimeout error = peerTimeout{}
+
+type peerTimeout struct{}
+
+func (peerTimeout) Error() string   { return "websox: peer timed out" }
+func (peerTimeout) Timeout() bool   { return true }
+func (peerTimeout) Temporary() bool { return true }
+
+// keepalive pings the peer from its own goroutine, independently of
+// other writes to the connection, and declares the peer dead once
+// too many pings in a row go unanswered
+type keepalive struct {
+	conn   *websocket.Conn
+	freq   time.Duration
+	missed int32 // unanswered pings allowed, zero never gives up
+
+	unanswered atomic.Int32
+	held       atomic.Bool // misses are not counted while set
+	failed     chan error  // the ping error, or ErrPeerTimeout
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// startKeepalive pings conn every freq until stopped,
+// returning nil if freq is not positive
+func startKeepalive(conn *websocket.Conn, freq time.Duration, missed int) *keepalive {
+	if freq <= 0 {
+		return nil
+	}
+	k := &keepalive{
+		conn:   conn,
+		freq:   freq,
+		missed: int32(missed),
+		failed: make(chan error, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+func (k *keepalive) run() {
+	defer close(k.done)
+	ticker := time.NewTicker(k.freq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.quit:
+			return
+		case <-ticker.C:
+			// a ping stuck behind a slow write may have outlasted the session
+			select {
+			case <-k.quit:
+				return
+			default:
+			}
+			if k.missed > 0 && k.unanswered.Load() >= k.missed {
+				k.failed <- ErrPeerTimeout
+				return
+			}
+			if err := ping(k.conn); err != nil {
+				k.failed <- err
+				return
+			}
+			if !k.held.Load() {
+				k.unanswered.Add(1)
+			}
+		}
+	}
+}
+
+// alive records that the peer was heard from
+func (k *keepalive) alive() {
+	if k != nil {
+		k.unanswered.Store(0)
+	}
+}
+
+// hold stops counting unanswered pings until release,
+// while the reader is busy and cannot take pongs
+func (k *keepalive) hold() {
+	if k != nil {
+		k.held.Store(true)
+	}
+}
+
+// release counts unanswered pings again, starting afresh
+func (k *keepalive) release() {
+	if k != nil {
+		k.unanswered.Store(0)
+		k.held.Store(false)
+	}
+}
+
+// dead returns the channel that gets why the peer is no longer reachable,
+// nil if it is not pinged
+func (k *keepalive) dead() <-chan error {
+	if k == nil {
+		return nil
+	}
+	return k.failed
+}
+
+// stop ends the pings, waiting until none is being sent
+func (k *keepalive) stop() {
+	if k == nil {
+		return
+	}
+	close(k.quit)
+	<-k.done
+}
+
+func ping(conn *websocket.Conn) error {
+	now := time.Now()
+	err := conn.WriteControl(websocket.PingMessage, []byte(now.String()), now.Add(writeWait))
+	if err != nil && err != websocket.ErrCloseSent {
+		if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pingCounter counts the pings conn gets, answering them if pong is set
+func pingCounter(conn *websocket.Conn, pong bool) *atomic.Int32 {
+	var pings atomic.Int32
+	answer := conn.PingHandler()
+	conn.SetPingHandler(func(s string) error {
+		pings.Add(1)
+		if pong {
+			// a pong fails once the server has closed the connection,
+			// and the close frame it sent first is still to be read
+			answer(s)
+		}
+		return nil
+	})
+	return &pings
+}
+
+// rawClient replies to every push on conn until the connection closes
+func rawClient(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, r, err := conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		env, body, err := readFrame(JSON, r)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, body)
+		if err := conn.WriteJSON(Results{Seq: env.Seq}); err != nil {
+			return err
+		}
+	}
+}
+
+// busy is a Setup that pushes a message every millisecond for d
+func busy(d time.Duration) Setup {
+	return func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+				getter <- Stuff{Msg: "busy"}.NewReader()
+				if _, ok := <-teller; !ok {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(getter)
+			for range teller {
+			}
+		}()
+		return getter, teller
+	}
+}
+
+func TestNoPings(t *testing.T) {
+	var calls atomic.Int32
+	all := make(chan []Results, 1)
+	cfg := PusherConfig{Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(counted([]string{"a", "b"}, &calls, all)))
+	defer ts.Close()
+
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pings := pingCounter(conn, true)
+	if err := rawClient(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-all; len(got) != 2 || pings.Load() != 0 {
+		t.Errorf("got %d pings and results: %+v", pings.Load(), got)
+	}
+}
+
+// TestPingsWhileBusy checks that pings keep to time while messages flow
+func TestPingsWhileBusy(t *testing.T) {
+	const (
+		freq     = time.Millisecond * 10
+		duration = time.Millisecond * 150
+	)
+	cfg := PusherConfig{PingFreq: freq, MissedPongs: 3, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(busy(duration)))
+	defer ts.Close()
+
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pings := pingCounter(conn, true)
+	if err := rawClient(conn); err != nil {
+		t.Fatal(err)
+	}
+	if n := pings.Load(); n < int32(duration/freq)/2 {
+		t.Errorf("only %d pings in %s", n, duration)
+	}
+}
+
+func TestMissedPongs(t *testing.T) {
+	for _, pong := range []bool{true, false} {
+		metrics := endings{ended: make(chan string, 1)}
+		cfg := PusherConfig{
+			Hub:         &Hub{},
+			PingFreq:    time.Millisecond * 10,
+			MissedPongs: 2,
+			Metrics:     metrics,
+			Logger:      FromLogger(logger),
+		}
+		ts := httptest.NewServer(cfg.Pusher(nil))
+
+		conn, err := dial(ts.URL, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pings := pingCounter(conn, pong)
+		done := make(chan error, 1)
+		go func() {
+			done <- rawClient(conn)
+		}()
+
+		select {
+		case reason := <-metrics.ended:
+			if pong || reason != EndPeerTimeout {
+				t.Errorf("answering pongs %t, session ended with: %q", pong, reason)
+			}
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+			if n := pings.Load(); n != 2 {
+				t.Errorf("session ended after %d pings", n)
+			}
+		case <-time.After(time.Millisecond * 100):
+			if !pong {
+				t.Error("session without pongs did not end")
+			}
+		}
+		conn.Close()
+		ts.Close()
+	}
+}
+
+func TestPingFailure(t *testing.T) {
+	if k := startKeepalive(nil, 0, 1); k != nil || k.dead() != nil {
+		t.Error("pings without a frequency")
+	}
+
+	cfg := PusherConfig{Hub: &Hub{}, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.UnderlyingConn().Close()
+
+	k := startKeepalive(conn, time.Millisecond, 0)
+	defer k.stop()
+	select {
+	case err := <-k.dead():
+		if err == nil || err == ErrPeerTimeout {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ping did not fail")
+	}
+}
+
+// pingServer accepts connections that only read, sending the count
+// of pings each one got, answered if pong is set, on counts once it closes
+func pingServer(pong bool, counts chan<- int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		pings := pingCounter(conn, pong)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				break
+			}
+		}
+		counts <- pings.Load()
+	}))
+}
+
+func TestClientPings(t *testing.T) {
+	for _, pong := range []bool{true, false} {
+		counts := make(chan int32, 1)
+		ts := pingServer(pong, counts)
+
+		cfg := ClientConfig{PingFreq: time.Millisecond * 10, MissedPongs: 2, Logger: FromLogger(logger)}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		err := cfg.Client(ctx, ts.URL, gotIt)
+		cancel()
+		pings := <-counts
+		switch {
+		case pong && (err != context.DeadlineExceeded || pings < 5):
+			t.Errorf("answered server got %d pings and ended with: %v", pings, err)
+		case !pong && (err != ErrPeerTimeout || pings != 2):
+			t.Errorf("silent server got %d pings and ended with: %v", pings, err)
+		}
+		ts.Close()
+	}
+}
+
+// TestClientPingsSlowAction checks that pongs the client cannot read
+// while it handles a message are not counted as missed
+func TestClientPingsSlowAction(t *testing.T) {
+	cfg := PusherConfig{PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 2)))
+	defer ts.Close()
+
+	slow := func(r io.Reader) (interface{}, bool, error) {
+		time.Sleep(time.Millisecond * 200)
+		return gotIt(r)
+	}
+	client := ClientConfig{PingFreq: time.Millisecond * 20, MissedPongs: 2, Logger: FromLogger(logger)}
+	if err := client.Client(context.Background(), ts.URL, slow); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+// TestKeepaliveStop checks that no pings go out once stopped
+func TestKeepaliveStop(t *testing.T) {
+	cfg := PusherConfig{Hub: &Hub{}, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	k := startKeepalive(conn, time.Millisecond, 0)
+	time.Sleep(time.Millisecond * 20)
+	k.stop()
+	select {
+	case err := <-k.dead():
+		t.Errorf("stopped keepalive failed: %v", err)
+	default:
+	}
+	sent := k.unanswered.Load()
+	if sent == 0 {
+		t.Error("no pings sent")
+	}
+	time.Sleep(time.Millisecond * 5)
+	if n := k.unanswered.Load(); n != sent {
+		t.Errorf("%d pings sent after stopping", n-sent)
+	}
+}
+
+// TestContactedSerial checks that pongs and replies heard together
+// never have Contacted called concurrently
+func TestContactedSerial(t *testing.T) {
+	var active, calls, overlaps atomic.Int32
+	contacted := func() {
+		if active.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		calls.Add(1)
+		time.Sleep(time.Millisecond)
+		active.Add(-1)
+	}
+	cfg := PusherConfig{
+		PingFreq:  time.Millisecond,
+		Contacted: contacted,
+		Logger:    FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(busy(time.Millisecond * 100)))
+	defer ts.Close()
+
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pings := pingCounter(conn, true)
+	if err := rawClient(conn); err != nil {
+		t.Fatal(err)
+	}
+	if pings.Load() == 0 || calls.Load() == 0 {
+		t.Fatalf("got %d pings and %d contacts", pings.Load(), calls.Load())
+	}
+	if n := overlaps.Load(); n > 0 {
+		t.Errorf("Contacted called concurrently %d times", n)
+	}
+}
@@ -0,0 +1,113 @@
+package websox
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// oneShot sends a single message and hands back its results
+func oneShot(done chan Results) Setup {
+	return func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			getter <- Stuff{Msg: "one shot", Count: 1, TS: time.Now()}.NewReader()
+			results, ok := <-teller
+			if ok {
+				done <- results
+			}
+			close(getter)
+			for range teller {
+			}
+			close(done)
+		}()
+		return getter, teller
+	}
+}
+
+// silent never sends anything
+func silent() (chan io.Reader, chan Results) {
+	return make(chan io.Reader), make(chan Results)
+}
+
+func TestReplyTimeout(t *testing.T) {
+	done := make(chan Results, 1)
+	cfg := PusherConfig{
+		PingFreq:     testPing,
+		ReplyTimeout: time.Millisecond * 50,
+		Logger:       FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(oneShot(done)))
+	defer ts.Close()
+
+	if err := Client(ts.URL, sleeper(logger, cfg.ReplyTimeout*2), true, nil, logger); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	results := <-done
+	if !results.TimedOut() || results.Seq != 1 {
+		t.Fatalf("expected reply timeout but got: %+v", results)
+	}
+}
+
+func TestServerReadLimit(t *testing.T) {
+	done := make(chan Results, 1)
+	cfg := PusherConfig{
+		PingFreq:       testPing,
+		MaxMessageSize: 64,
+		Logger:         FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(oneShot(done)))
+	defer ts.Close()
+
+	verbose := func(r io.Reader) (interface{}, bool, error) {
+		return strings.Repeat("too long ", 64), true, nil
+	}
+	err := Client(ts.URL, verbose, true, nil, logger)
+	if closed, ok := err.(*CloseError); !ok || closed.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("expected message too big close but got: %v", err)
+	}
+	if results, ok := <-done; ok {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+}
+
+func TestClientReadLimit(t *testing.T) {
+	ts := httptest.NewServer(Pusher(MakeFake(logger), testExpires, testPing, nil, logger))
+	defer ts.Close()
+
+	cfg := ClientConfig{MaxMessageSize: 16, Logger: FromLogger(logger)}
+	if err := cfg.Client(context.Background(), ts.URL, gotIt); err != websocket.ErrReadLimit {
+		t.Fatalf("expected read limit error but got: %v", err)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	ts := httptest.NewServer(Pusher(silent, testExpires, testPing, nil, logger))
+	defer ts.Close()
+
+	cfg := ClientConfig{IdleTimeout: time.Millisecond * 50, Logger: FromLogger(logger)}
+	err := cfg.Client(context.Background(), ts.URL, gotIt)
+	if e, ok := errors.Cause(err).(net.Error); !ok || !e.Timeout() || err != ErrPeerTimeout {
+		t.Fatalf("expected timeout error but got: %v", err)
+	}
+}
+
+func TestClientIdlePings(t *testing.T) {
+	idle := time.Millisecond * 50
+	ts := httptest.NewServer(Pusher(silent, idle*4, idle/3, nil, logger))
+	defer ts.Close()
+
+	cfg := ClientConfig{IdleTimeout: idle, Logger: FromLogger(logger)}
+	// the pings keep the client going until the session expires
+	if err := cfg.Client(context.Background(), ts.URL, gotIt); !expired(err) {
+		t.Fatal("unexpected error:", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// sessions numbers the sessions served by all Pushers
+var sessions atomic.Uint64
+
+// FromLogger returns a slog.Logger that writes through logger,
+// as used by the functions that take a *log.Logger
+//
+// All levels are logged, with the time left to the flags of logger
+func FromLogger(logger *log.Logger) *slog.Logger {
+	if logger == nil {
+		return nil
+	}
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	return slog.New(slog.NewTextHandler(logWriter{logger}, opts))
+}
+
+// logWriter hands each formatted record to a log.Logger
+type logWriter struct {
+	logger *log.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	if err := w.logger.Output(callDepth(), strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// callDepth returns the depth for log.Logger.Output that reports
+// the code that logged the record rather than the slog internals
+func callDepth() int {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for depth := 2; ; depth++ {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "log/slog.") || !more {
+			return depth
+		}
+	}
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for use by concurrent loggers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFromLogger(t *testing.T) {
+	var buf bytes.Buffer
+	slogger := FromLogger(log.New(&buf, "prefix ", 0))
+	slogger.Debug("pushed", "seq", 7, "bytes", 42)
+
+	const expected = "prefix level=DEBUG msg=pushed seq=7 bytes=42\n"
+	if got := buf.String(); got != expected {
+		t.Fatalf("got %q -- expected %q", got, expected)
+	}
+	// the file reported is where the record was logged
+	buf.Reset()
+	FromLogger(log.New(&buf, "", log.Lshortfile)).Info("located")
+	if got := buf.String(); !strings.HasPrefix(got, "log_test.go:") {
+		t.Fatalf("unexpected source: %q", got)
+	}
+	if FromLogger(nil) != nil {
+		t.Fatal("expected nil logger")
+	}
+}
+
+func TestSessionLogging(t *testing.T) {
+	var buf syncBuffer
+	slogger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	cfg := PusherConfig{
+		PingFreq: testPing,
+		Logger:   slogger,
+	}
+	pusher := cfg.Pusher(sendX(t, 3))
+	served := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pusher(w, r)
+		close(served)
+	}))
+	defer ts.Close()
+
+	if err := (ClientConfig{Logger: FromLogger(logger)}).Client(context.Background(), ts.URL, takeX(t, 0, nil)); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+
+	out := buf.String()
+	// a session that ends normally has nothing to warn about
+	if strings.Contains(out, "level=WARN") {
+		t.Errorf("warnings logged:\n%s", out)
+	}
+	for _, expected := range []string{
+		"msg=\"session started\"",
+		"msg=pushed session=",
+		" seq=3 bytes=",
+		"msg=reply",
+		"msg=\"session ended\"",
+		"pushed=3 answered=3",
+		" remote=127.0.0.1:",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("log is missing %q:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"expvar"
+	"time"
+)
+
+// Reasons a Pusher session ends, as given to Metrics.SessionEnded
+const (
+	EndSrcClosed    = "src closed"    // the Setup producer closed its channel
+	EndExpired      = "expired"       // the session reached its expiration
+	EndClosed       = "closed"        // the client closed the connection
+	EndPingError    = "ping error"    // the client could not be pinged
+	EndPeerTimeout  = "peer timeout"  // the client stopped answering pings
+	EndReadError    = "read error"    // a client reply could not be read
+	EndWriteError   = "write error"   // a push could not be sent
+	EndCancelled    = "cancelled"     // the request or shutdown context was done
+	EndPanic        = "panic"         // a callback panicked with Recovery.Close set
+	EndServerClosed = "server closed" // the session was closed through its Hub
+	EndSuspended    = "suspended"     // the connection failed, leaving the session to be resumed
+	EndReplyTimeout = "reply timeout" // a client without seqs left a push unanswered past ReplyTimeout
+)
+
+// Metrics receives the activity of Pusher sessions
+//
+// Implementations are shared by all sessions and must be safe for concurrent use
+type Metrics interface {
+	// SessionStarted is called once a client connection is upgraded
+	SessionStarted()
+
+	// SessionEnded is called with one of the End reasons when a session finishes
+	SessionEnded(reason string)
+
+	// Pushed is called with the payload size of each message sent
+	Pushed(bytes int64)
+
+	// Received is called with the size of each client reply
+	Received(bytes int)
+
+	// Replied is called with the time between a push and its reply,
+	// and whether the client reported an error in its Results
+	Replied(latency time.Duration, failed bool)
+
+	// TimedOut is called for each push that failed with ErrReplyTimeout
+	TimedOut()
+}
+
+// nopMetrics discards all activity
+type nopMetrics struct{}
+
+func (nopMetrics) SessionStarted()             {}
+func (nopMetrics) SessionEnded(string)         {}
+func (nopMetrics) Pushed(int64)                {}
+func (nopMetrics) Received(int)                {}
+func (nopMetrics) Replied(time.Duration, bool) {}
+func (nopMetrics) TimedOut()                   {}
+
+// LatencyBuckets are the upper bounds of the round trip latency histogram
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// ExpvarMetrics is a Metrics that publishes its counters with expvar
+type ExpvarMetrics struct {
+	active    expvar.Int
+	started   expvar.Int
+	ended     expvar.Map // by reason
+	pushed    expvar.Int
+	sent      expvar.Int // bytes
+	received  expvar.Int // bytes
+	replies   expvar.Int
+	errors    expvar.Int
+	timeouts  expvar.Int
+	latency   expvar.Map // counts by bucket upper bound
+	latencyNS expvar.Int // total of all latencies
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics published as an expvar.Map under name
+//
+// As with expvar.Publish, it panics if name is already in use
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{}
+	m.ended.Init()
+	m.latency.Init()
+
+	vars := expvar.NewMap(name)
+	vars.Set("sessions_active", &m.active)
+	vars.Set("sessions_started", &m.started)
+	vars.Set("sessions_ended", &m.ended)
+	vars.Set("messages_pushed", &m.pushed)
+	vars.Set("bytes_sent", &m.sent)
+	vars.Set("bytes_received", &m.received)
+	vars.Set("replies", &m.replies)
+	vars.Set("reply_errors", &m.errors)
+	vars.Set("reply_timeouts", &m.timeouts)
+	vars.Set("latency_buckets", &m.latency)
+	vars.Set("latency_ns_total", &m.latencyNS)
+	return m
+}
+
+func (m *ExpvarMetrics) SessionStarted() {
+	m.active.Add(1)
+	m.started.Add(1)
+}
+
+func (m *ExpvarMetrics) SessionEnded(reason string) {
+	m.active.Add(-1)
+	m.ended.Add(reason, 1)
+}
+
+func (m *ExpvarMetrics) Pushed(bytes int64) {
+	m.pushed.Add(1)
+	m.sent.Add(bytes)
+}
+
+func (m *ExpvarMetrics) Received(bytes int) {
+	m.received.Add(int64(bytes))
+}
+
+func (m *ExpvarMetrics) Replied(latency time.Duration, failed bool) {
+	m.replies.Add(1)
+	if failed {
+		m.errors.Add(1)
+	}
+	m.latencyNS.Add(int64(latency))
+	m.latency.Add(bucket(latency), 1)
+}
+
+func (m *ExpvarMetrics) TimedOut() {
+	m.timeouts.Add(1)
+}
+
+// bucket returns the name of the latency bucket for d
+func bucket(d time.Duration) string {
+	for _, bound := range LatencyBuckets {
+		if d <= bound {
+			return bound.String()
+		}
+	}
+	return "+Inf"
+}
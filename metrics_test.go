@@ -0,0 +1,73 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// expvarRuns numbers the expvar names published by the tests,
+// which cannot be reused when tests are run repeatedly
+var expvarRuns atomic.Int32
+
+func TestExpvarMetrics(t *testing.T) {
+	name := fmt.Sprintf("websox_test_%d", expvarRuns.Add(1))
+	metrics := NewExpvarMetrics(name)
+	cfg := PusherConfig{
+		PingFreq: testPing,
+		Metrics:  metrics,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 3)))
+	defer ts.Close()
+
+	failing := takeX(t, 0, errors.New("no thanks"))
+	if err := (ClientConfig{Logger: FromLogger(logger)}).Client(context.Background(), ts.URL, failing); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := expvar.Get(name).(*expvar.Map)
+	for name, expected := range map[string]int64{
+		"sessions_active":  0,
+		"sessions_started": 1,
+		"messages_pushed":  3,
+		"replies":          3,
+		"reply_errors":     3,
+		"reply_timeouts":   0,
+	} {
+		if got := vars.Get(name).(*expvar.Int).Value(); got != expected {
+			t.Errorf("%s is %d -- expected %d", name, got, expected)
+		}
+	}
+	if got := metrics.ended.Get(EndSrcClosed); got == nil || got.String() != "1" {
+		t.Errorf("unexpected sessions ended: %s", metrics.ended.String())
+	}
+	if metrics.sent.Value() == 0 || metrics.received.Value() == 0 {
+		t.Errorf("bytes not counted -- sent: %d received: %d", metrics.sent.Value(), metrics.received.Value())
+	}
+}
+
+func TestBucket(t *testing.T) {
+	for _, test := range []struct {
+		latency  time.Duration
+		expected string
+	}{
+		{0, "1ms"},
+		{time.Millisecond, "1ms"},
+		{time.Millisecond * 7, "10ms"},
+		{time.Minute, "+Inf"},
+	} {
+		if got := bucket(test.latency); got != test.expected {
+			t.Errorf("bucket for %s is %s -- expected %s", test.latency, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may connect to a Pusher
+//
+// Requests without an Origin header, i.e., from non-browser clients, are always allowed.
+// The zero value only allows origins matching the host of the request
+type OriginPolicy struct {
+	// Allowed lists the permitted origins, such as "https://dash.example.com"
+	//
+	// The scheme or port may be omitted to match any scheme or port,
+	// a host of the form "*.example.com" matches any subdomain of example.com,
+	// and "*" allows every origin
+	Allowed []string
+
+	// Check is consulted for origins that are not in Allowed
+	Check func(origin *url.URL, r *http.Request) bool
+}
+
+// Allow reports whether the request's origin is permitted,
+// suitable for use as a websocket.Upgrader CheckOrigin function
+func (p OriginPolicy) Allow(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if len(p.Allowed) == 0 && p.Check == nil {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range p.Allowed {
+		if originMatch(allowed, u) {
+			return true
+		}
+	}
+	return p.Check != nil && p.Check(u, r)
+}
+
+// originMatch compares an allowed origin pattern with an origin
+func originMatch(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], origin.Scheme) {
+			return false
+		}
+		host = pattern[i+3:]
+	}
+
+	// without a port in the pattern any port is accepted
+	target := origin.Host
+	if strings.LastIndex(host, ":") <= strings.LastIndex(host, "]") {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		target = origin.Hostname()
+	}
+	if strings.HasPrefix(host, "*.") {
+		suffix := strings.ToLower(host[1:])
+		return strings.HasSuffix(strings.ToLower(target), suffix)
+	}
+	return strings.EqualFold(host, target)
+}
@@ -0,0 +1,82 @@
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	dashboard := OriginPolicy{
+		Allowed: []string{"https://dash.example.com", "*.corp.example.com", "http://localhost:8080"},
+		Check: func(origin *url.URL, r *http.Request) bool {
+			return origin.Host == "partner.example.org"
+		},
+	}
+	tests := []struct {
+		policy OriginPolicy
+		host   string
+		origin string
+		want   bool
+	}{
+		{OriginPolicy{}, "push.example.com", "", true},
+		{OriginPolicy{}, "push.example.com", "https://push.example.com", true},
+		{OriginPolicy{}, "push.example.com", "https://dash.example.com", false},
+		{OriginPolicy{}, "push.example.com", "not a url", false},
+		{dashboard, "push.example.com", "https://dash.example.com", true},
+		{dashboard, "push.example.com", "https://dash.example.com:8443", true},
+		{dashboard, "push.example.com", "http://dash.example.com", false},
+		{dashboard, "push.example.com", "https://a.corp.example.com", true},
+		{dashboard, "push.example.com", "http://b.a.corp.example.com", true},
+		{dashboard, "push.example.com", "https://corp.example.com", false},
+		{dashboard, "push.example.com", "https://evilcorp.example.com", false},
+		{dashboard, "push.example.com", "http://localhost:8080", true},
+		{dashboard, "push.example.com", "http://localhost:9090", false},
+		{dashboard, "push.example.com", "https://partner.example.org", true},
+		{dashboard, "push.example.com", "https://push.example.com", false},
+		{OriginPolicy{Allowed: []string{"*"}}, "push.example.com", "https://anywhere.net", true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+"/push", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := test.policy.Allow(r); got != test.want {
+			t.Errorf("origin %q allowed: %t -- expected: %t", test.origin, got, test.want)
+		}
+	}
+}
+
+func TestOriginRefused(t *testing.T) {
+	var started int
+	setup := func() (chan io.Reader, chan Results) {
+		started++
+		return sendX(t, 1)()
+	}
+	cfg := PusherConfig{
+		Origins:  OriginPolicy{Allowed: []string{"https://dash.example.com"}},
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	allowed := ClientConfig{Headers: http.Header{"Origin": {"https://dash.example.com"}}, Logger: FromLogger(logger)}
+	if err := allowed.Client(context.Background(), ts.URL, gotIt); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	refused := ClientConfig{Headers: http.Header{"Origin": {"https://evil.example.com"}}, Logger: FromLogger(logger)}
+	err := refused.Client(context.Background(), ts.URL, gotIt)
+	if err == nil {
+		t.Fatal("expected origin to be refused")
+	}
+	t.Log("got expected error:", err)
+
+	if started != 1 {
+		t.Fatalf("setup was called %d times -- expected: 1", started)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outbox keeps the messages from a Pusher's Setup until clients reply to them,
+// so messages lost with a connection are delivered again
+//
+// Each message is saved with a unique ID before it is pushed,
+// and deleted once the client's Results are received. Messages that
+// are still pending when a session starts are pushed again first,
+// and their Results are not passed on to the new session's Setup.
+// Delivery is at least once, clients can use the message ID,
+// see ReaderID, to recognize messages they have already handled
+type Outbox struct {
+	// Store holds the pending messages
+	Store OutboxStore
+
+	// Key identifies the client a session is for, so that only its own
+	// pending messages are redelivered to it. If nil all sessions share
+	// the same messages, and they should not overlap
+	Key func(r *http.Request) string
+}
+
+// OutboxMessage is a message awaiting a reply
+type OutboxMessage struct {
+	ID      string
+	Payload []byte
+	Created time.Time
+}
+
+// OutboxStore persists Outbox messages, grouped by client key
+//
+// Implementations must be safe for concurrent use
+type OutboxStore interface {
+	// Save adds a message for key
+	Save(key string, msg OutboxMessage) error
+
+	// Pending returns the messages for key, ordered by ID
+	Pending(key string) ([]OutboxMessage, error)
+
+	// Delete removes a message once it is acknowledged
+	Delete(key, id string) error
+}
+
+var idCounter atomic.Uint32
+
+// newID returns a unique message ID, IDs created later sort after earlier ones
+func newID() string {
+	return fmt.Sprintf("%016x%08x", time.Now().UnixNano(), idCounter.Add(1))
+}
+
+// ReaderID returns the Outbox message ID of a message received by an Actionable,
+// or "" if the server does not keep it in an Outbox
+//
+// A message that was redelivered has the same ID as when it was first pushed
+func ReaderID(r io.Reader) string {
+	if cr, ok := r.(contextReader); ok {
+		return cr.id
+	}
+	return ""
+}
+
+// mailbox is an Outbox bound to the key of a session
+type mailbox struct {
+	store OutboxStore
+	key   string
+}
+
+// mailbox returns the outbox for the session of r, nil if there is no Outbox
+func (o *Outbox) mailbox(r *http.Request) *mailbox {
+	if o == nil || o.Store == nil {
+		return nil
+	}
+	box := &mailbox{store: o.Store}
+	if o.Key != nil {
+		box.key = o.Key(r)
+	}
+	return box
+}
+
+// MemoryStore is an OutboxStore that keeps messages in memory,
+// so they survive reconnects but not restarts
+type MemoryStore struct {
+	mu       sync.Mutex
+	messages map[string][]OutboxMessage
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: make(map[string][]OutboxMessage)}
+}
+
+func (m *MemoryStore) Save(key string, msg OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[key] = append(m.messages[key], msg)
+	return nil
+}
+
+func (m *MemoryStore) Pending(key string) ([]OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]OutboxMessage(nil), m.messages[key]...), nil
+}
+
+func (m *MemoryStore) Delete(key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	messages := m.messages[key]
+	for i, msg := range messages {
+		if msg.ID == id {
+			m.messages[key] = append(messages[:i:i], messages[i+1:]...)
+			break
+		}
+	}
+	if len(m.messages[key]) == 0 {
+		delete(m.messages, key)
+	}
+	return nil
+}
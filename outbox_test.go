@@ -0,0 +1,130 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Save("k", OutboxMessage{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Delete("k", "b")
+	store.Delete("other", "a")
+	pending, _ := store.Pending("k")
+	if len(pending) != 2 || pending[0].ID != "a" || pending[1].ID != "c" {
+		t.Errorf("pending: %+v", pending)
+	}
+	store.Delete("k", "a")
+	store.Delete("k", "c")
+	if pending, _ := store.Pending("k"); len(pending) != 0 {
+		t.Errorf("pending after delete: %+v", pending)
+	}
+
+	if a, b := newID(), newID(); a >= b {
+		t.Errorf("id %s does not sort before %s", a, b)
+	}
+}
+
+// redelivery drops the connection of client before a push is answered,
+// and then reconnects it, returning each message the Actionable got with its ID
+// and the IDs of the messages answered to the producer
+func redelivery(t *testing.T, client ClientConfig) (got, answered []string) {
+	t.Helper()
+	store := NewMemoryStore()
+	cfg := PusherConfig{
+		Outbox:   &Outbox{Store: store},
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+
+	var (
+		session int
+		ended   = make(chan struct{})
+		ids     = make(chan string, 10)
+	)
+	setup := func() (chan io.Reader, chan Results) {
+		session++
+		msgs := []string{`"one"`, `"two"`}
+		if session > 1 {
+			msgs = []string{`"three"`}
+		}
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			defer close(getter)
+			for _, msg := range msgs {
+				getter <- strings.NewReader(msg)
+				results, ok := <-teller
+				if !ok {
+					// the first session ends with "two" unanswered
+					close(ended)
+					return
+				}
+				if results.ErrMsg != "" {
+					t.Errorf("session %d push failed: %s", session, results.ErrMsg)
+				}
+				ids <- results.ID
+			}
+		}()
+		return getter, teller
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	action := func(r io.Reader) (interface{}, bool, error) {
+		b, _ := io.ReadAll(r)
+		got = append(got, string(b)+"@"+ReaderID(r))
+		if string(b) == `"two"` && ctx.Err() == nil {
+			// hang up before answering
+			cancel()
+			<-ended
+		}
+		return "ok", true, nil
+	}
+
+	client.Logger = FromLogger(logger)
+	client.Client(ctx, ts.URL, action)
+	if pending, _ := store.Pending(""); len(pending) != 1 || string(pending[0].Payload) != `"two"` {
+		t.Fatalf("pending after drop: %+v", pending)
+	}
+
+	if err := client.Client(context.Background(), ts.URL, action); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.Pending(""); len(pending) != 0 {
+		t.Errorf("pending after redelivery: %+v", pending)
+	}
+	close(ids)
+	for id := range ids {
+		answered = append(answered, id)
+	}
+	return got, answered
+}
+
+func TestOutbox(t *testing.T) {
+	got, answered := redelivery(t, ClientConfig{})
+
+	// the producer only hears about its own messages
+	if len(answered) != 2 || len(got) != 4 {
+		t.Fatalf("client got: %q, producer got answers for %q", got, answered)
+	}
+	one, three := answered[0], answered[1]
+	two := strings.TrimPrefix(got[1], `"two"@`)
+	expected := []string{`"one"@` + one, `"two"@` + two, `"two"@` + two, `"three"@` + three}
+	if !reflect.DeepEqual(got, expected) || one == "" || two == "" || three == "" {
+		t.Errorf("client got: %q -- expected %q", got, expected)
+	}
+}
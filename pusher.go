@@ -7,36 +7,23 @@
 package websox
 
 import (
-	"encoding/json"
-	"fmt"
+	"bytes"
+	"context"
 	"io"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
-	"os"
-	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	writeWait = time.Second
 )
 
-var (
-	mu      sync.Mutex
-	counter int
-)
-
-func pusherID() string {
-	mu.Lock()
-	counter++
-	id := fmt.Sprintf("id:%03d ", counter)
-	mu.Unlock()
-	return id
-}
-
 // Setup returns a channel to get data and one that return an error value and optional artifacts
 // from the results of that action
 //
@@ -44,146 +31,796 @@ func pusherID() string {
 // it should return a nil interface channel and send an error message in the error channel
 //
 // The Results channel is closed by Pusher() when it is done processing (due to session timeout or error)
+//
+// Goroutines producing the data can be started with Recovery.Go to have their panics recovered
 type Setup func() (chan io.Reader, chan Results)
 
 // Pusher gets send/recv channels from the setup function
 // and sets up the environment for bringing up an event loop on the websocket connection
+//
+// Each message is sent and its reply awaited before the next is sent.
+// PusherConfig.Pusher offers the other options
 func Pusher(setup Setup, expires, pingFreq time.Duration, contacted func(), logger *log.Logger) http.HandlerFunc {
+	return PusherContext(context.Background(), setup, 1, expires, pingFreq, contacted, logger)
+}
+
+// PusherContext is a Pusher with up to window messages in flight, whose
+// sessions end when either the request context or the server wide shutdown
+// context is done
+//
+// The codecs are offered to clients in order of preference,
+// only JSON is supported if none are given
+func PusherContext(shutdown context.Context, setup Setup, window int, expires, pingFreq time.Duration, contacted func(), logger *log.Logger, codecs ...Codec) http.HandlerFunc {
+	return PusherConfig{
+		Shutdown:  shutdown,
+		Window:    window,
+		Expires:   expires,
+		PingFreq:  pingFreq,
+		Contacted: contacted,
+		Codecs:    codecs,
+		Logger:    FromLogger(logger),
+	}.Pusher(setup)
+}
+
+// Pusher returns a handler that pushes the data from setup
+// to each client that connects, as configured
+//
+// If cfg.Hub is set, setup may be nil to push only what is sent through the Hub,
+// and if cfg.Requests is set, setup may be nil to only answer client requests
+//
+// If cfg.ResumeGrace is set, a client that reconnects to a session
+// whose connection failed continues it rather than calling setup again
+func (cfg PusherConfig) Pusher(setup Setup) http.HandlerFunc {
+	if len(cfg.Codecs) == 0 {
+		cfg.Codecs = []Codec{JSON}
+	}
+	if cfg.Shutdown == nil {
+		cfg.Shutdown = context.Background()
+	}
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = nopMetrics{}
+	}
+	upgrader := cfg.upgrader()
+	resumable := newResumer(cfg.ResumeGrace)
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		if logger == nil {
-			logger = log.New(os.Stderr, pusherID(), LogFlags)
+		id := sessions.Add(1)
+		logger := cfg.Logger.With(
+			slog.Uint64("session", id),
+			slog.String("remote", r.RemoteAddr),
+		)
+
+		if !cfg.Origins.Allow(r) {
+			logger.Warn("origin refused", "origin", r.Header.Get("Origin"))
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
 		}
 
 		// getter gets data to be sent,
 		// teller returns results of what was sent
-		getter, teller := setup()
-		if getter == nil {
-			logger.Println("aborted results")
-			results := <-teller
-			logger.Println("closing teller - app startup failure")
-			close(teller)
-			logger.Println("Pusher setup error:", results.ErrMsg)
-			http.Error(w, results.ErrMsg, http.StatusInternalServerError)
-			return
+		var (
+			getter chan io.Reader
+			teller chan Results
+		)
+		st, resumed := resumable.take(r)
+		if !resumed && setup != nil {
+			err := cfg.Recovery.catch("Setup", logger, func() {
+				getter, teller = setup()
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if getter == nil {
+				results := <-teller
+				close(teller)
+				logger.Error("pusher setup failed", "error", results.ErrMsg)
+				http.Error(w, results.ErrMsg, http.StatusInternalServerError)
+				return
+			}
+		}
+		if !resumed {
+			st = newStream(getter, teller, resumable.token(), cfg.Expires)
 		}
 
-		upgrader := websocket.Upgrader{} // use default options
-		conn, err := upgrader.Upgrade(w, r, nil)
+		var header http.Header
+		if st.token != "" {
+			header = http.Header{sessionHeader: {st.token}}
+		}
+		conn, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
-			logger.Print("push upgrade error:", err)
+			logger.Warn("push upgrade failed", "error", err)
+			switch {
+			case resumed:
+				resumable.detach(st, true, logger)
+			case teller != nil:
+				// the producer is told there is no session
+				close(teller)
+			}
 			return
 		}
+		if cfg.MaxMessageSize > 0 {
+			conn.SetReadLimit(cfg.MaxMessageSize)
+		}
+		codec := negotiated(conn, cfg.Codecs)
+		if err := cfg.Compression.apply(conn); err != nil {
+			logger.Warn("compression level not applied", "level", cfg.Compression.Level, "error", err)
+		}
+		cfg.Metrics.SessionStarted()
+		logger.Info("session started",
+			"codec", codec.Name(),
+			"compression", cfg.Compression.Enabled && compressed(r.Header),
+			"resumed", resumed,
+		)
+
+		// a panic in a callback, or a close through the Hub, can end the session
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		stop := context.AfterFunc(cfg.Shutdown, func() { cancel(nil) })
+		defer stop()
+
+		var sess *Session
+		if cfg.Hub != nil {
+			sess = cfg.Hub.register(id, r, cancel)
+			defer cfg.Hub.unregister(sess)
+		}
+		resumable.attach(st, cancel)
 
 		// optional monitoring of activity
-		if contacted != nil {
-			contacted()
-			conn.SetPongHandler(func(s string) error {
-				contacted()
-				return nil
-			})
+		contacted := func() {
+			if sess != nil {
+				sess.touch()
+			}
+			if cfg.Contacted != nil {
+				if err := cfg.Recovery.catch("Contacted", logger, cfg.Contacted); err != nil && cfg.Recovery.Close {
+					cancel(err)
+				}
+			}
 		}
+		contacted()
 
 		// listen for messages from client
-		listener(conn, getter, teller, pingFreq, expires, contacted, logger)
+		suspended := listener(ctx, conn, codec, st, sess, cfg.Outbox.mailbox(r), contacted, cfg, logger)
+		resumable.detach(st, suspended, logger)
 	}
 }
 
-func ping(conn *websocket.Conn) error {
-	now := time.Now()
-	err := conn.WriteControl(websocket.PingMessage, []byte(now.String()), now.Add(writeWait))
-	if err != nil && err != websocket.ErrCloseSent {
-		if e, ok := err.(net.Error); ok && e.Temporary() {
-			return nil
+// replies reads client replies and forwards them until the connection fails,
+// leaving the read error in failed before out is closed.
+// Subscription changes from the client are applied to sess,
+// and client requests are forwarded to asks
+//
+// It is the only reader of conn, leaving the listener free to queue writes
+func replies(conn *websocket.Conn, codec Codec, sess *Session, out chan<- Results, asks chan<- request, quit <-chan struct{}, failed *error, metrics Metrics, logger *slog.Logger) {
+	defer close(out)
+	for {
+		messageType, r, err := conn.NextReader()
+		if err != nil {
+			select {
+			case <-quit:
+				// the listener is done and closed the connection
+				logger.Debug("reply reading stopped", "error", err)
+			default:
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logger.Warn("reply read failed", "error", err)
+				}
+			}
+			*failed = err
+			return
+		}
+		if messageType != frameType(codec) {
+			logger.Warn("unexpected message type", "type", messageType)
+			continue
+		}
+
+		var msg upstream
+		b, err := io.ReadAll(r)
+		metrics.Received(len(b))
+		if err == nil {
+			err = codec.Unmarshal(b, &msg)
+		}
+		if err != nil {
+			logger.Warn("reply decode failed", "error", err)
+			msg = upstream{Results: Results{ErrMsg: err.Error()}}
+		}
+
+		if sub := msg.Subscription; sub != nil {
+			switch {
+			case sess == nil:
+				logger.Warn("subscription ignored, sessions are not in a hub")
+			default:
+				if err := sess.hub.subscription(sess.id, *sub); err != nil {
+					logger.Warn("subscription failed", "error", err)
+					break
+				}
+				logger.Debug("subscription", "subscribe", sub.Subscribe, "unsubscribe", sub.Unsubscribe)
+			}
+			continue
+		}
+
+		if req := msg.Request; req != nil {
+			select {
+			case asks <- *req:
+			case <-quit:
+				return
+			}
+			continue
+		}
+
+		results := msg.Results
+		results.codec = codec
+
+		select {
+		case out <- results:
+		case <-quit:
+			return
 		}
 	}
-	return err
+}
+
+// push is a message awaiting its reply
+type push struct {
+	sent        time.Time
+	span        trace.Span   // nil unless tracing
+	reply       chan Results // where the reply goes if sent through a Hub
+	id          string       // the Outbox message ID, if any
+	redelivered bool         // left unanswered by an earlier session
+	env         envelope     // as sent, kept with body to replay in a resumed session
+	body        []byte
+}
+
+// abandon ends a push that will not be answered
+func (p push) abandon(seq uint64, why string) {
+	endPush(p.span, Results{Seq: seq, ErrMsg: why})
+	if p.reply != nil {
+		p.reply <- Results{Seq: seq, ErrMsg: ErrSessionClosed.Error()}
+	}
 }
 
 // handle incoming messages
-// no concurrent access for conn, so all is controlled here
+// replies is the only reader of conn and the writer the only writer of frames,
+// so what is sent is decided here without waiting on either
+//
+// The session ends when the producer is done and all replies are in,
+// the session expires, the connection fails, or ctx is done.
+// Messages sent through a Hub to sess are pushed alongside those from src.
+// If box is set, messages from src are kept in it until answered,
+// and those it already holds are pushed before any others
+//
+// It reports whether the session is suspended rather than ended,
+// leaving st to be resumed on a new connection
 func listener(
+	ctx context.Context,
 	conn *websocket.Conn,
-	src chan io.Reader,
-	response chan Results,
-	pingFreq, expires time.Duration,
+	codec Codec,
+	st *stream,
+	sess *Session,
+	box *mailbox,
 	contacted func(),
-	logger *log.Logger,
-) {
+	cfg PusherConfig,
+	logger *slog.Logger,
+) (suspended bool) {
+
+	var (
+		started         = time.Now()
+		end             = EndSrcClosed
+		pushed, written int64
+		answered, lost  int64
+	)
+
+	var (
+		src, response = st.src, st.response
+		seq           = st.seq
+		pending       = st.pending // replies not yet taken by the Setup producer
+		redeliver     = st.redeliver
+		ended         bool
+		stale         bool // a legacy client left a push unanswered
+	)
+
+	// unanswered pushes
+	inflight := st.inflight
+
+	// legacy clients take one push at a time and reply without its Seq
+	window := cfg.Window
+	if legacy(conn) {
+		window = 1
+	}
+
+	// why the client is told the session closed, with text replacing the reason's own
+	closing, text := CloseProducerFinished, ""
+	quit := make(chan struct{})
+	read := make(chan struct{}) // closed once replies stops reading
+
+	// frames are written by their own goroutine, so nothing here
+	// waits on the client, and are queued until it takes them
+	out := startWriter(conn, codec, cfg.Compression.Threshold)
+	var (
+		queued  []outbound
+		writing int // frames taken by the writer and not yet reported
+	)
 
 	defer func() {
-		close(response)
-		logger.Println("websocket server closing")
-		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-		if err := conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
-			logger.Println("websocket server close message error:", err)
+		// a failed connection leaves the session for the client to resume,
+		// apart from what was sent through a Hub
+		switch {
+		case end == EndReadError || end == EndWriteError || end == EndPingError || end == EndPeerTimeout:
+			suspended = st.token != "" && !ended && ctx.Err() == nil
+		case context.Cause(ctx) == errResumed:
+			suspended = true
+		}
+		for seq, p := range inflight {
+			if !suspended || p.reply != nil {
+				p.abandon(seq, "session ended: "+end)
+				delete(inflight, seq)
+			}
+		}
+		if suspended && src == nil && len(inflight) == 0 && len(redeliver) == 0 {
+			// nothing is left to resume
+			suspended = false
+		}
+		close(quit)
+		if suspended {
+			logger.Info("session suspended", "cause", end, "unanswered", len(inflight), "grace", cfg.ResumeGrace)
+			st.seq, st.pending, st.redeliver = seq, pending, redeliver
+			end = EndSuspended
+		} else {
+			if response != nil {
+				close(response)
+			}
+		}
+		logger.Info("session ended",
+			"reason", end,
+			"pushed", pushed,
+			"answered", answered,
+			"timeouts", lost,
+			"bytes", written,
+			"duration", time.Since(started),
+		)
+		cfg.Metrics.SessionEnded(end)
+		switch end {
+		case EndClosed, EndReadError, EndWriteError, EndPingError, EndPeerTimeout, EndSuspended:
+			// the client is gone, or will be back for the session
+			closing = CloseUnknown
+		}
+		out.stop()
+		if err := conn.WriteMessage(websocket.CloseMessage, closing.message(text)); err != nil && err != websocket.ErrCloseSent {
+			logger.Debug("close message not sent", "error", err)
 		}
 		conn.Close()
+		<-read
 	}()
 
 	var expired <-chan time.Time
-	if expires != 0 {
-		expired = time.NewTimer(expires).C
+	if !st.expires.IsZero() {
+		expired = time.NewTimer(time.Until(st.expires)).C
+	}
+
+	// the client is pinged throughout, and any word from it
+	// shows it is still there
+	pings := startKeepalive(conn, cfg.PingFreq, cfg.MissedPongs)
+	defer pings.stop()
+	heard := func() {
+		pings.alive()
+		contacted()
+	}
+	// pongs are read by replies, so Contacted is left to run here
+	// and is never called concurrently for the session
+	ponged := make(chan struct{}, 1)
+	conn.SetPongHandler(func(string) error {
+		pings.alive()
+		select {
+		case ponged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	var readErr error
+	incoming := make(chan Results)
+	asks := make(chan request)
+	go func() {
+		defer close(read)
+		replies(conn, codec, sess, incoming, asks, quit, &readErr, cfg.Metrics, logger)
+	}()
+
+	var (
+		overdue    <-chan time.Time
+		deliveries chan delivery
+		answers    = make(chan answer)
+		handling   int // requests being handled
+	)
+	if sess != nil {
+		deliveries = sess.in
+	}
+
+	// without a producer the session lasts as long as the client
+	// to answer its requests
+	serving := src == nil && cfg.Requests != nil
+
+	// messages left unanswered by earlier sessions
+	if box != nil && !st.resumed {
+		var err error
+		if redeliver, err = box.store.Pending(box.key); err != nil {
+			logger.Error("outbox read failed", "error", err)
+		} else if len(redeliver) > 0 {
+			logger.Info("redelivering", "messages", len(redeliver))
+		}
 	}
 
+	// send queues r to be pushed as p, reporting whether it could be
+	//
+	// Messages from src in a resumable session are read in full first,
+	// and kept until answered so they can be replayed
+	send := func(parent context.Context, env envelope, r io.Reader, p push) bool {
+		seq++
+		env.Seq = seq
+		if st.token != "" && p.reply == nil {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				logger.Warn("push failed", "seq", seq, "error", err)
+				p.abandon(seq, err.Error())
+				return false
+			}
+			st.offset++
+			env.Offset = st.offset
+			p.body, r = b, bytes.NewReader(b)
+		}
+		p.span = cfg.Tracing.startPush(parent, &env)
+		p.env = env
+		p.sent = time.Now()
+		inflight[seq] = p
+		queued = append(queued, outbound{env: env, body: r})
+		return true
+	}
+
+	// keep saves a message from src in the outbox before it is sent
+	keep := func(parent context.Context, r io.Reader) bool {
+		msg := OutboxMessage{ID: newID(), Created: time.Now()}
+		b, err := io.ReadAll(r)
+		if err == nil {
+			msg.Payload = b
+			err = box.store.Save(box.key, msg)
+		}
+		if err != nil {
+			// the producer is told, rather than the message going out unkept
+			seq++
+			logger.Error("outbox save failed", "seq", seq, "error", err)
+			pending = append(pending, Results{Seq: seq, ErrMsg: errors.Wrap(err, "outbox save error").Error()})
+			return true
+		}
+		return send(parent, envelope{ID: msg.ID}, bytes.NewReader(b), push{id: msg.ID})
+	}
+
+	// serve answers a client request
+	serve := func(req request) {
+		a := answer{id: req.ID}
+		var (
+			reply interface{}
+			err   = ErrNoHandler
+		)
+		if cfg.Requests != nil {
+			perr := cfg.Recovery.catch("Requests", logger, func() {
+				reply, err = cfg.Requests(ctx, sess, bytes.NewReader(req.Payload))
+			})
+			if perr != nil {
+				err = perr
+			}
+		}
+		if err == nil && reply != nil {
+			a.payload, err = codec.Marshal(reply)
+		}
+		if err != nil {
+			a.errMsg = err.Error()
+		}
+		select {
+		case answers <- a:
+		case <-quit:
+		}
+	}
+
+	// answer hands the reply to a push back to its sender,
+	// replies to redelivered messages have no one waiting on them
+	answer := func(p push, results Results) {
+		endPush(p.span, results)
+		results.ID = p.id
+		switch {
+		case p.reply != nil:
+			p.reply <- results
+		case !p.redelivered && response != nil:
+			pending = append(pending, results)
+		}
+	}
+
+	// the pushes left unanswered by the last connection are sent again,
+	// apart from those the client says it answered
+	if st.resumed {
+		for _, s := range st.unanswered() {
+			p := inflight[s]
+			if p.env.Offset <= st.acked {
+				logger.Warn("reply lost", "seq", s, "offset", p.env.Offset)
+				delete(inflight, s)
+				if p.id != "" {
+					if err := box.store.Delete(box.key, p.id); err != nil {
+						logger.Warn("outbox delete failed", "id", p.id, "error", err)
+					}
+				}
+				answer(p, Results{Seq: s, ErrMsg: ErrReplyLost.Error()})
+				continue
+			}
+			logger.Debug("replaying", "seq", s, "offset", p.env.Offset)
+			p.sent = time.Now()
+			inflight[s] = p
+			queued = append(queued, outbound{env: p.env, body: bytes.NewReader(p.body)})
+		}
+	}
+
+	replyTimer := time.NewTimer(time.Hour)
+	defer replyTimer.Stop()
+
 	for {
-		logger.Println("waiting for input")
+		for len(redeliver) > 0 && len(inflight) < window {
+			m := redeliver[0]
+			redeliver = redeliver[1:]
+			if !send(ctx, envelope{ID: m.ID}, bytes.NewReader(m.Payload), push{id: m.ID, redelivered: true}) {
+				end = EndWriteError
+				return
+			}
+		}
+
+		// once the producer is done or the session has expired
+		// we only wait on outstanding replies
+		if src == nil && deliveries == nil && !serving && len(inflight) == 0 && len(pending) == 0 &&
+			(handling == 0 || incoming == nil) && len(queued) == 0 && writing == 0 {
+			switch {
+			case incoming == nil && websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+				end = EndClosed
+			case incoming == nil:
+				end = EndReadError
+			case stale:
+				end = EndReplyTimeout
+				closing, text = ClosePolicyViolation, "reply timeout"
+			case ended:
+				end = EndExpired
+				closing = CloseSessionExpired
+			}
+			return
+		}
+
+		input, hubInput := src, deliveries
+		if len(inflight) >= window {
+			input, hubInput = nil, nil
+		}
+
+		var (
+			output chan Results
+			next   Results
+		)
+		if len(pending) > 0 {
+			output = response
+			next = pending[0]
+		}
+
+		var (
+			writes chan outbound
+			frame  outbound
+		)
+		if len(queued) > 0 {
+			writes = out.in
+			frame = queued[0]
+		}
+
+		// time out the oldest unanswered push
+		overdue = nil
+		if cfg.ReplyTimeout > 0 && len(inflight) > 0 {
+			var oldest time.Time
+			for _, p := range inflight {
+				if oldest.IsZero() || p.sent.Before(oldest) {
+					oldest = p.sent
+				}
+			}
+			if !replyTimer.Stop() {
+				select {
+				case <-replyTimer.C:
+				default:
+				}
+			}
+			replyTimer.Reset(time.Until(oldest.Add(cfg.ReplyTimeout)))
+			overdue = replyTimer.C
+		}
 
-		ticker := time.NewTicker(pingFreq)
 		select {
-		case <-expired:
-			logger.Println("session expired")
+		case <-ctx.Done():
+			end, closing = EndCancelled, CloseServerShutdown
+			switch cause := context.Cause(ctx).(type) {
+			case *PanicError:
+				end = EndPanic
+				closing, text = CloseServerError, "panic in "+cause.Callback
+			case *CloseError:
+				end, closing = EndServerClosed, cause.Reason
+			default:
+				if cause == errResumed {
+					closing = CloseSessionResumed
+				}
+			}
 			return
-		case <-ticker.C:
-			if err := ping(conn); err != nil {
-				logger.Println("ping error:", err)
+		case <-expired:
+			logger.Debug("session expiring", "inflight", len(inflight))
+			ended = true
+			expired = nil
+			src = nil
+			deliveries = nil
+			redeliver = nil
+			serving = false
+		case <-ponged:
+			contacted()
+		case err := <-pings.dead():
+			if err == ErrPeerTimeout {
+				logger.Warn("client stopped answering pings", "missed", cfg.MissedPongs)
+				end = EndPeerTimeout
 				return
 			}
-		case r, ok := <-src:
+			logger.Warn("ping failed", "error", err)
+			end = EndPingError
+			return
+		case r, ok := <-input:
 			if !ok {
-				logger.Println("src closed")
-				return
+				// the session ends with its producer
+				src = nil
+				deliveries = nil
+				continue
 			}
-
-			// send our message
-			w, err := conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				logger.Println("writer error:", err)
-				return
+			if p, ok := r.(producerPanic); ok {
+				logPanic(logger, p.PanicError)
+				if p.close {
+					end = EndPanic
+					closing, text = CloseServerError, "panic in "+p.Callback
+					return
+				}
+				// the session ends with its producer, even if resumed,
+				// and no one is left to take the replies
+				st.src = finishedSrc
+				src = nil
+				deliveries = nil
+				pending = nil
+				if response != nil {
+					close(response)
+					response, st.response = nil, nil
+				}
+				continue
 			}
-
-			if _, err = io.Copy(w, r); err != nil {
-				logger.Println("copy error:", err)
+			parent, ok := readerContext(r)
+			if !ok {
+				parent = ctx
+			}
+			var sent bool
+			if box != nil {
+				sent = keep(parent, r)
+			} else {
+				sent = send(parent, envelope{}, r, push{})
+			}
+			if !sent {
+				end = EndWriteError
 				return
 			}
-
-			if err := w.Close(); err == nil {
-				logger.Println("close error:", err)
+		case d := <-hubInput:
+			if err := d.ctx.Err(); err != nil {
+				d.reply <- Results{ErrMsg: err.Error()}
+				continue
 			}
-
-			logger.Println("waiting for reader")
-			messageType, r, err := conn.NextReader()
-			if err != nil {
-				logger.Println("listener read error:", err)
+			if !send(d.ctx, envelope{Topic: d.topic}, bytes.NewReader(d.msg), push{reply: d.reply}) {
+				end = EndWriteError
 				return
 			}
-			logger.Println("we have a reply")
-			if contacted != nil {
-				contacted()
+		case results, ok := <-incoming:
+			if !ok {
+				if st.token != "" && !ended && !websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					end = EndReadError
+					return
+				}
+				// replies already received are still handed back
+				// but nothing more can be sent or answered
+				incoming = nil
+				src = nil
+				deliveries = nil
+				redeliver = nil
+				serving = false
+				queued = nil
+				for seq, p := range inflight {
+					p.abandon(seq, "connection closed")
+					delete(inflight, seq)
+				}
+				continue
 			}
-
-			switch messageType {
-			case websocket.TextMessage:
-				var results Results
-				if err := json.NewDecoder(r).Decode(&results); err != nil {
-					logger.Println("status json error:", err)
-					results = Results{ErrMsg: err.Error()}
+			heard()
+			// a reply from a legacy client, or one that could not be decoded,
+			// can only be matched if there is a single message outstanding
+			// and no earlier push timed out, whose reply it may be
+			if results.Seq == 0 && len(inflight) == 1 && lost == 0 {
+				for seq := range inflight {
+					results.Seq = seq
 				}
-				response <- results
-			case websocket.CloseMessage:
-				logger.Println("uhoh! closing time!")
+			}
+			p, ok := inflight[results.Seq]
+			if !ok {
+				logger.Warn("reply for unknown push", "seq", results.Seq)
+				continue
+			}
+			elapsed := time.Since(p.sent)
+			logger.Debug("reply", "seq", results.Seq, "elapsed", elapsed, "error", results.ErrMsg)
+			cfg.Metrics.Replied(elapsed, results.ErrMsg != "")
+			answered++
+			delete(inflight, results.Seq)
+			if p.id != "" {
+				if err := box.store.Delete(box.key, p.id); err != nil {
+					logger.Warn("outbox delete failed", "id", p.id, "error", err)
+				}
+			}
+			answer(p, results)
+		case req := <-asks:
+			heard()
+			logger.Debug("request", "request", req.ID, "bytes", len(req.Payload))
+			handling++
+			go serve(req)
+		case a := <-answers:
+			handling--
+			if incoming == nil {
+				// the client is gone
+				continue
+			}
+			env := envelope{Request: a.id, Error: a.errMsg}
+			queued = append(queued, outbound{env: env, body: bytes.NewReader(a.payload)})
+		case writes <- frame:
+			queued = queued[1:]
+			writing++
+		case w := <-out.out:
+			writing--
+			env := w.env
+			switch {
+			case w.err != nil && incoming == nil:
+				logger.Debug("write failed after connection closed", "seq", env.Seq, "request", env.Request, "error", w.err)
+			case w.err != nil:
+				logger.Warn("write failed", "seq", env.Seq, "request", env.Request, "error", w.err)
+				if p, ok := inflight[env.Seq]; ok && env.Seq != 0 && env.Offset == 0 {
+					p.abandon(env.Seq, w.err.Error())
+					delete(inflight, env.Seq)
+				}
+				end = EndWriteError
 				return
+			case env.Request != 0:
+				logger.Debug("answered", "request", env.Request, "bytes", w.n, "error", env.Error)
+			default:
+				logger.Debug("pushed", "seq", env.Seq, "bytes", w.n, "id", env.ID)
+				cfg.Metrics.Pushed(w.n)
+				pushed++
+				written += w.n
+			}
+		case now := <-overdue:
+			for seq, p := range inflight {
+				if now.Sub(p.sent) >= cfg.ReplyTimeout {
+					logger.Warn("reply timeout", "seq", seq, "elapsed", now.Sub(p.sent))
+					cfg.Metrics.TimedOut()
+					lost++
+					delete(inflight, seq)
+					answer(p, Results{Seq: seq, ErrMsg: ErrReplyTimeout.Error(), codec: codec})
+				}
 			}
+			if lost > 0 && legacy(conn) && !stale {
+				// its late reply could not be told from that to the next push,
+				// so the session ends once the producer has the timeout
+				stale = true
+				src = nil
+				deliveries = nil
+				redeliver = nil
+				serving = false
+			}
+		case output <- next:
+			pending = pending[1:]
 		}
-
 	}
 }
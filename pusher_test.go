@@ -1,6 +1,8 @@
 package websox
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -254,7 +256,217 @@ func TestPingOk(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(Pusher(sender, expires, ping, contacted, logger)))
 	defer ts.Close()
 
-	if err := Client(ts.URL, sleeper(logger, timeout), true, nil, logger); err != nil {
+	if err := Client(ts.URL, sleeper(logger, timeout), true, nil, logger); !expired(err) {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+// pipelinedClient reads count pushes before replying to them in reverse order
+func pipelinedClient(url string, count int, logger *log.Logger) error {
+	conn, err := dial(url, nil, logger)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	seqs := make([]uint64, 0, count)
+	for i := 0; i < count; i++ {
+		_, r, err := conn.NextReader()
+		if err != nil {
+			return errors.Wrapf(err, "read %d of %d", i+1, count)
+		}
+		env, _, err := readFrame(JSON, r)
+		if err != nil {
+			return err
+		}
+		seqs = append(seqs, env.Seq)
+	}
+	for i := len(seqs) - 1; i >= 0; i-- {
+		if err := conn.WriteJSON(Results{Seq: seqs[i]}); err != nil {
+			return err
+		}
+	}
+	_, _, err = conn.NextReader()
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return nil
+	}
+	return err
+}
+
+func TestWindowed(t *testing.T) {
+	const limit = 3
+
+	done := make(chan []uint64)
+	sender := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			for i := 0; i < limit; i++ {
+				getter <- Stuff{Msg: "windowed", Count: i, TS: time.Now()}.NewReader()
+			}
+			close(getter)
+		}()
+		go func() {
+			var seqs []uint64
+			for results := range teller {
+				seqs = append(seqs, results.Seq)
+			}
+			done <- seqs
+		}()
+		return getter, teller
+	}
+
+	cfg := PusherConfig{Window: limit, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(sender))
+	defer ts.Close()
+
+	if err := pipelinedClient(ts.URL, limit, logger); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	seqs := <-done
+	if len(seqs) != limit {
+		t.Fatalf("expected %d results but got: %v", limit, seqs)
+	}
+	for i, seq := range seqs {
+		if want := uint64(limit - i); seq != want {
+			t.Errorf("result %d has seq %d -- expected: %d", i, seq, want)
+		}
+	}
+}
+
+// legacyClient answers pushes the way clients did before the envelope,
+// decoding each message as sent and replying without its Seq
+func legacyClient(url string) ([]Stuff, error) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+url[4:], nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var got []Stuff
+	for {
+		_, r, err := conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return got, nil
+		}
+		if err != nil {
+			return got, err
+		}
+		var s Stuff
+		if err := json.NewDecoder(r).Decode(&s); err != nil {
+			return got, errors.Wrap(err, "push decode error")
+		}
+		got = append(got, s)
+		reply := json.RawMessage(fmt.Sprint(s.Count))
+		if err := conn.WriteJSON(Results{Payload: &reply}); err != nil {
+			return got, err
+		}
+	}
+}
+
+// TestLegacyClient checks that a client negotiating no subprotocol
+// is pushed bare messages one at a time, whatever the Window
+func TestLegacyClient(t *testing.T) {
+	const limit = 3
+
+	done := make(chan []Results)
+	sender := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			for i := 0; i < limit; i++ {
+				getter <- Stuff{Msg: "legacy", Count: i, TS: time.Now()}.NewReader()
+			}
+			close(getter)
+		}()
+		go func() {
+			var all []Results
+			for results := range teller {
+				all = append(all, results)
+			}
+			done <- all
+		}()
+		return getter, teller
+	}
+
+	cfg := PusherConfig{Window: limit, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(sender))
+	defer ts.Close()
+
+	got, err := legacyClient(ts.URL)
+	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
+	if len(got) != limit {
+		t.Fatalf("client got %d of %d pushes", len(got), limit)
+	}
+	all := <-done
+	if len(all) != limit {
+		t.Fatalf("expected %d results but got: %+v", limit, all)
+	}
+	for i, results := range all {
+		var count int
+		if err := results.Decode(&count); err != nil || results.Seq != uint64(i+1) || count != i || got[i].Count != i {
+			t.Errorf("result %d: %+v %d (%v)", i, results, count, err)
+		}
+	}
+}
+
+// TestLegacyReplyTimeout checks that a late reply from a legacy client
+// ends its session rather than being taken for that to the next push
+func TestLegacyReplyTimeout(t *testing.T) {
+	metrics := endings{ended: make(chan string, 1)}
+	done := make(chan []Results)
+	sender := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader, 2)
+		teller := make(chan Results)
+		for i := 0; i < 2; i++ {
+			getter <- Stuff{Msg: "late", Count: i, TS: time.Now()}.NewReader()
+		}
+		close(getter)
+		go func() {
+			var all []Results
+			for results := range teller {
+				all = append(all, results)
+			}
+			done <- all
+		}()
+		return getter, teller
+	}
+	cfg := PusherConfig{
+		ReplyTimeout: time.Millisecond * 50,
+		PingFreq:     testPing,
+		Metrics:      metrics,
+		Logger:       FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sender))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+ts.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, _, err := conn.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 75)
+	reply := json.RawMessage("0")
+	conn.WriteJSON(Results{Payload: &reply})
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+
+	if reason := <-metrics.ended; reason != EndReplyTimeout {
+		t.Errorf("session ended with: %q", reason)
+	}
+	if all := <-done; len(all) != 1 || !all[0].TimedOut() {
+		t.Errorf("unexpected results: %+v", all)
+	}
 }
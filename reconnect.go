@@ -0,0 +1,164 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// HeaderFunc returns the http headers to dial with,
+// allowing credentials to be refreshed before each connection attempt
+type HeaderFunc func() (http.Header, error)
+
+// ReconnectPolicy controls how ClientConfig.Reconnect redials after a connection ends
+type ReconnectPolicy struct {
+	// Initial is the delay before the first retry after a failure,
+	// and before redialing a server that closed the connection normally
+	Initial time.Duration
+
+	// Max caps the delay between retries
+	Max time.Duration
+
+	// Multiplier grows the delay after each consecutive failure
+	Multiplier float64
+
+	// Jitter randomizes each delay by up to this fraction of it (0 to 1)
+	Jitter float64
+
+	// MaxAttempts is the number of consecutive failures allowed
+	// before giving up, zero retries forever
+	MaxAttempts int
+
+	// StopOnClose returns when the server closes the connection normally,
+	// with the *CloseError for an expired session,
+	// rather than redialing
+	StopOnClose bool
+}
+
+// DefaultReconnect is a reasonable policy for long running clients
+var DefaultReconnect = ReconnectPolicy{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// delay returns how long to wait after the given number of consecutive failures
+func (p ReconnectPolicy) delay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.Initial) * math.Pow(multiplier, float64(failures-1))
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Reconnect runs a Client against url using the config for each connection,
+// redialing as directed by policy until ctx is done
+//
+// Failures to get headers, dial, or stay connected, including a server
+// that stops answering with ErrPeerTimeout, are retried with exponential backoff.
+// A normal close by the server, including an expired session, redials after policy.Initial
+// unless policy.StopOnClose is set, when its *CloseError is returned if it gave one.
+// A *CloseError whose Temporary method reports false is returned without redialing.
+// It returns nil once fn asks to stop, the last error once policy.MaxAttempts is reached,
+// or ctx.Err() once ctx is done
+//
+// Headers from the headers function, if given, replace cfg.Headers
+func (cfg ClientConfig) Reconnect(ctx context.Context, url string, fn Actionable, headers HeaderFunc, policy ReconnectPolicy) error {
+	cfg = cfg.defaults()
+	logger := cfg.Logger
+
+	// track whether the client itself decided to finish,
+	// which workers may do concurrently
+	var stopped atomic.Bool
+	action := func(r io.Reader) (interface{}, bool, error) {
+		reply, ok, err := fn(r)
+		if !ok {
+			stopped.Store(true)
+		}
+		return reply, ok, err
+	}
+
+	var failures int
+	for {
+		connected, err := reconnect(ctx, url, action, headers, cfg)
+		closed, _ := err.(*CloseError)
+		normal := err == nil || closed != nil && closed.Code == websocket.CloseNormalClosure
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case normal && (stopped.Load() || policy.StopOnClose):
+			return err
+		case normal:
+			// a server whose sessions end right away is not redialed in a tight loop
+			failures = 0
+			wait := policy.delay(1)
+			logger.Info("server closed connection, reconnecting", "url", url, "wait", wait, "error", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		case stopped.Load():
+			return err
+		case closed != nil && !closed.Temporary():
+			// connecting again would be refused, or take the session from its new connection
+			logger.Warn("server closed session for good", "url", url, "reason", closed.Reason)
+			return err
+		}
+
+		// a session that got established restarts the backoff
+		if connected {
+			failures = 0
+		}
+		failures++
+		if policy.MaxAttempts > 0 && failures >= policy.MaxAttempts {
+			return errors.Wrapf(err, "giving up after %d attempts", failures)
+		}
+		wait := policy.delay(failures)
+		logger.Warn("connection failed, retrying", "url", url, "failures", failures, "wait", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reconnect makes a single connection and runs the client until it ends,
+// reporting whether the connection was established
+func reconnect(ctx context.Context, url string, fn Actionable, headers HeaderFunc, cfg ClientConfig) (bool, error) {
+	if headers != nil {
+		var err error
+		if cfg.Headers, err = headers(); err != nil {
+			return false, errors.Wrap(err, "header error")
+		}
+	}
+	conn, codec, err := connect(ctx, url, cfg)
+	if err != nil {
+		return false, err
+	}
+	return true, client(ctx, conn, codec, fn, cfg)
+}
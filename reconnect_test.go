@@ -0,0 +1,140 @@
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	policy := ReconnectPolicy{
+		Initial:    time.Millisecond * 10,
+		Max:        time.Millisecond * 100,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+	for failures := 1; failures < 10; failures++ {
+		base := time.Millisecond * 10 << uint(failures-1)
+		if base > policy.Max {
+			base = policy.Max
+		}
+		low, high := base/2, base+base/2
+		for i := 0; i < 100; i++ {
+			if d := policy.delay(failures); d < low || d > high {
+				t.Fatalf("failure %d delay %s is outside of %s - %s", failures, d, low, high)
+			}
+		}
+	}
+}
+
+// TestReconnectClosed redials after each normal close until the client is done
+func TestReconnectClosed(t *testing.T) {
+	const sessions = 3
+
+	ts := httptest.NewServer(http.HandlerFunc(Pusher(sendX(t, 1), testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	var dials, count int
+	headers := func() (http.Header, error) {
+		dials++
+		return nil, nil
+	}
+	counter := func(r io.Reader) (interface{}, bool, error) {
+		count++
+		return nil, count < sessions, nil
+	}
+	policy := ReconnectPolicy{Initial: time.Millisecond, MaxAttempts: 1}
+	cfg := ClientConfig{Logger: FromLogger(logger)}
+	if err := cfg.Reconnect(context.Background(), ts.URL, counter, headers, policy); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if dials != sessions {
+		t.Fatalf("expected %d dials but got: %d", sessions, dials)
+	}
+}
+
+// TestReconnectPace waits between sessions that the server ends right away
+func TestReconnectPace(t *testing.T) {
+	const (
+		initial = time.Millisecond * 20
+		runFor  = time.Millisecond * 200
+	)
+	finished := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		close(getter)
+		return getter, make(chan Results)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(Pusher(finished, testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	var dials atomic.Int32
+	headers := func() (http.Header, error) {
+		dials.Add(1)
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), runFor)
+	defer cancel()
+	cfg := ClientConfig{Logger: FromLogger(logger)}
+	policy := ReconnectPolicy{Initial: initial, Max: time.Second, Multiplier: 2}
+	if err := cfg.Reconnect(ctx, ts.URL, gotIt, headers, policy); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error:", err)
+	}
+	if n := dials.Load(); n < 2 || n > int32(runFor/initial)+1 {
+		t.Fatalf("%d dials in %s", n, runFor)
+	}
+}
+
+// TestReconnectStopOnClose returns once the server closes the session
+func TestReconnectStopOnClose(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(Pusher(sendX(t, 1), testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	var dials int
+	headers := func() (http.Header, error) {
+		dials++
+		return nil, nil
+	}
+	policy := ReconnectPolicy{StopOnClose: true}
+	cfg := ClientConfig{Logger: FromLogger(logger)}
+	if err := cfg.Reconnect(context.Background(), ts.URL, takeX(t, 0, nil), headers, policy); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if dials != 1 {
+		t.Fatalf("expected 1 dial but got: %d", dials)
+	}
+}
+
+// TestReconnectGiveUp retries failed dials until out of attempts
+func TestReconnectGiveUp(t *testing.T) {
+	const attempts = 3
+
+	var dials int
+	headers := func() (http.Header, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("token server unavailable")
+		}
+		return nil, nil
+	}
+	policy := ReconnectPolicy{
+		Initial:     time.Millisecond,
+		Multiplier:  2,
+		Jitter:      0.1,
+		MaxAttempts: attempts,
+	}
+	cfg := ClientConfig{Logger: FromLogger(logger)}
+	err := cfg.Reconnect(context.Background(), "http://127.0.0.2/bad/path", gotIt, headers, policy)
+	if err == nil {
+		t.Fatal("expected dial error")
+	}
+	t.Logf("got expected error: %v", err)
+	if dials != attempts {
+		t.Fatalf("expected %d dials but got: %d", attempts, dials)
+	}
+}
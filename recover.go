@@ -0,0 +1,106 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+)
+
+// PanicError is a panic recovered from a callback websox invoked
+type PanicError struct {
+	Callback string      // the callback that panicked, e.g. "Actionable" or "Setup"
+	Value    interface{} // the value given to panic
+	Stack    []byte      // the stack of the panicking goroutine
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("websox: panic in %s: %v", p.Callback, p.Value)
+}
+
+// Recovery configures what is done about panics in callbacks
+//
+// Panics in an Actionable or RequestHandler are answered with the panic
+// as the ErrMsg of the Results, a panic in Setup fails the HTTP request,
+// and panics in Contacted or a client's Key are logged.
+// Panics in goroutines started by a callback cannot be recovered by websox,
+// apart from Setup producers started with Go
+type Recovery struct {
+	// Close ends the session or client connection after a panic,
+	// rather than carrying on with the next message
+	Close bool
+
+	// Hook is called with each panic recovered, e.g. for error reporting
+	Hook func(*PanicError)
+}
+
+// logPanic logs a recovered panic
+func logPanic(logger *slog.Logger, perr *PanicError) {
+	logger.Error("panic recovered", "callback", perr.Callback, "panic", perr.Value, "stack", string(perr.Stack))
+}
+
+// catch calls fn, returning a *PanicError if the named callback panics
+func (rc Recovery) catch(callback string, logger *slog.Logger, fn func()) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = rc.recovered(callback, p, logger)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// recovered logs and hooks the panic p in the named callback
+func (rc Recovery) recovered(callback string, p interface{}, logger *slog.Logger) *PanicError {
+	perr := &PanicError{Callback: callback, Value: p, Stack: debug.Stack()}
+	logPanic(logger, perr)
+	if rc.Hook != nil {
+		rc.Hook(perr)
+	}
+	return perr
+}
+
+// Go runs fn on a new goroutine as the producer of the messages a Setup sends on src,
+// recovering a panic in it as in a callback
+//
+// The panic is sent on src after the messages fn sent, so it reaches the
+// session pushing from src. The session ends then if Close is set,
+// otherwise it carries on as if src had been closed
+func (rc Recovery) Go(src chan io.Reader, fn func()) {
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				perr := &PanicError{Callback: "Setup producer", Value: v, Stack: debug.Stack()}
+				if rc.Hook != nil {
+					rc.Hook(perr)
+				}
+				src <- producerPanic{PanicError: perr, close: rc.Close}
+			}
+		}()
+		fn()
+	}()
+}
+
+// producerPanic is sent on a Setup channel in place of a message
+// by a producer started with Recovery.Go that panicked
+type producerPanic struct {
+	*PanicError
+	close bool // the session ends rather than carrying on
+}
+
+// Read has no message to give
+func (producerPanic) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// finishedSrc stands in for the channel of a producer that panicked,
+// as it is closed
+var finishedSrc = func() chan io.Reader {
+	src := make(chan io.Reader)
+	close(src)
+	return src
+}()
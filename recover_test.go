@@ -0,0 +1,227 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// panicHook records the callbacks that panicked
+type panicHook struct {
+	mu     sync.Mutex
+	called []string
+}
+
+func (h *panicHook) hook(perr *PanicError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(perr.Stack) == 0 {
+		perr.Callback += " without stack"
+	}
+	h.called = append(h.called, perr.Callback)
+}
+
+func (h *panicHook) calls() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return strings.Join(h.called, " ")
+}
+
+// boom panics on the message "boom"
+func boom(t *testing.T) Actionable {
+	return func(r io.Reader) (interface{}, bool, error) {
+		msg := decoded(t, r)
+		if msg == "boom" {
+			panic("boom")
+		}
+		return msg, true, nil
+	}
+}
+
+func TestActionablePanic(t *testing.T) {
+	hook := &panicHook{}
+	cfg := ClientConfig{Recovery: Recovery{Hook: hook.hook}}
+	got := pushAll(t, []string{"a", "boom", "c"}, cfg, boom(t))
+	if len(got) != 3 || got[2].ErrMsg != "websox: panic in Actionable: boom" || got[3].ErrMsg != "" {
+		t.Errorf("results: %+v", got)
+	}
+	if calls := hook.calls(); calls != "Actionable" {
+		t.Errorf("hook called for: %q", calls)
+	}
+}
+
+func TestActionablePanicClose(t *testing.T) {
+	results := make(chan Results, 2)
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			defer close(results)
+			for _, msg := range []string{"a", "boom"} {
+				getter <- strings.NewReader(`"` + msg + `"`)
+				results <- <-teller
+			}
+			// the session ends without another message
+			<-teller
+		}()
+		return getter, teller
+	}
+	pusher := PusherConfig{PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(pusher.Pusher(setup))
+	defer ts.Close()
+
+	cfg := ClientConfig{Recovery: Recovery{Close: true}, Logger: FromLogger(logger)}
+	err := cfg.Client(context.Background(), ts.URL, boom(t))
+	if perr, ok := err.(*PanicError); !ok || perr.Callback != "Actionable" || perr.Value != "boom" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-results
+	if r := <-results; r.ErrMsg != err.Error() {
+		t.Errorf("panic answered with: %+v", r)
+	}
+}
+
+func TestSetupPanic(t *testing.T) {
+	hook := &panicHook{}
+	cfg := PusherConfig{
+		PingFreq: testPing,
+		Recovery: Recovery{Hook: hook.hook},
+		Logger:   FromLogger(logger),
+	}
+	setup := func() (chan io.Reader, chan Results) {
+		panic("no setup")
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	client := ClientConfig{Logger: FromLogger(logger)}
+	err := client.Client(context.Background(), ts.URL, boom(t))
+	if err == nil || !strings.Contains(err.Error(), "dial code:500") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls := hook.calls(); calls != "Setup" {
+		t.Errorf("hook called for: %q", calls)
+	}
+}
+
+// endings records why sessions end
+type endings struct {
+	nopMetrics
+	ended chan string
+}
+
+func (e endings) SessionEnded(reason string) {
+	e.ended <- reason
+}
+
+func TestContactedPanic(t *testing.T) {
+	hook := &panicHook{}
+	metrics := endings{ended: make(chan string, 1)}
+	cfg := PusherConfig{
+		Hub:       &Hub{},
+		PingFreq:  testPing,
+		Contacted: func() { panic("contact") },
+		Recovery:  Recovery{Close: true, Hook: hook.hook},
+		Metrics:   metrics,
+		Logger:    FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	client := ClientConfig{Logger: FromLogger(logger)}
+	err := client.Client(context.Background(), ts.URL, boom(t))
+	if closed, ok := err.(*CloseError); !ok || closed.Reason != CloseServerError || closed.Code != websocket.CloseInternalServerErr || closed.Text != "panic in Contacted" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls := hook.calls(); calls != "Contacted" {
+		t.Errorf("hook called for: %q", calls)
+	}
+	if reason := <-metrics.ended; reason != EndPanic {
+		t.Errorf("session ended with: %q", reason)
+	}
+}
+
+func TestProducerPanic(t *testing.T) {
+	for _, closing := range []bool{false, true} {
+		hook := &panicHook{}
+		metrics := endings{ended: make(chan string, 1)}
+		recovery := Recovery{Close: closing, Hook: hook.hook}
+		setup := func() (chan io.Reader, chan Results) {
+			getter := make(chan io.Reader)
+			teller := make(chan Results)
+			recovery.Go(getter, func() {
+				getter <- strings.NewReader(`"a"`)
+				<-teller
+				panic("no more")
+			})
+			return getter, teller
+		}
+		cfg := PusherConfig{
+			PingFreq: testPing,
+			Recovery: recovery,
+			Metrics:  metrics,
+			Logger:   FromLogger(logger),
+		}
+		ts := httptest.NewServer(cfg.Pusher(setup))
+
+		client := ClientConfig{Logger: FromLogger(logger)}
+		err := client.Client(context.Background(), ts.URL, boom(t))
+		ended := <-metrics.ended
+		switch {
+		case !closing && (err != nil || ended != EndSrcClosed):
+			t.Errorf("session carrying on ended with %q: %v", ended, err)
+		case closing:
+			closed, ok := err.(*CloseError)
+			if !ok || closed.Reason != CloseServerError || closed.Text != "panic in Setup producer" || ended != EndPanic {
+				t.Errorf("session closing ended with %q: %v", ended, err)
+			}
+		}
+		if calls := hook.calls(); calls != "Setup producer" {
+			t.Errorf("hook called for: %q", calls)
+		}
+		ts.Close()
+	}
+}
+
+// TestProducerNoSession checks that the producer of a request
+// that is not upgraded, such as a health check, is let go
+func TestProducerNoSession(t *testing.T) {
+	done := make(chan bool, 1)
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		Recovery{}.Go(getter, func() {
+			_, ok := <-teller
+			done <- ok
+		})
+		return getter, teller
+	}
+	cfg := PusherConfig{PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("producer got results")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("results channel left open")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoHandler answers client requests to a server without a RequestHandler,
+// or one that negotiated no subprotocol
+var ErrNoHandler = errors.New("websox: server does not accept requests")
+
+// RequestHandler answers a request sent by a client with a Requester
+//
+// The reply is encoded with the connection's Codec, and an error
+// is returned to the client as the ErrMsg of its Results.
+// sess is nil unless the Pusher has a Hub, and ctx is done when the session ends
+type RequestHandler func(ctx context.Context, sess *Session, r io.Reader) (interface{}, error)
+
+// request is a request from a client, numbered by the client for each connection
+//
+// The answer is a frame whose envelope has the request ID,
+// and the error from the handler if there was one
+type request struct {
+	ID      uint64 `json:"id" proto:"1"`
+	Payload []byte `json:"payload,omitempty" proto:"2"`
+}
+
+// answer is the outcome of a request
+type answer struct {
+	id      uint64
+	payload []byte
+	errMsg  string
+}
+
+// Requester sends requests from a client to its server,
+// alongside the Results of the messages pushed to it
+//
+// A Requester is set in a ClientConfig and may be shared by
+// the connections of ClientConfig.Reconnect. Answers are read between
+// pushes, so an Actionable can only wait on a Request if the client has Workers
+type Requester struct {
+	out chan outgoing
+}
+
+// outgoing is a request waiting to be sent
+type outgoing struct {
+	payload []byte
+	reply   chan outcome // buffered, so an abandoned request does not block the client
+}
+
+// outcome is what the client hears about a request
+type outcome struct {
+	results Results
+	err     error
+}
+
+// NewRequester returns a Requester to set in a ClientConfig
+func NewRequester() *Requester {
+	return &Requester{out: make(chan outgoing)}
+}
+
+// Request sends the contents of r to the server and waits for its answer,
+// waiting for the client to connect if it is not connected
+//
+// A reply from the server's RequestHandler is decoded with Results.Decode,
+// and an error from the handler is given as Results.ErrMsg. An error is
+// returned if ctx is done or the connection closes before the answer is received,
+// and ErrNoHandler if the server negotiated no subprotocol
+func (rq *Requester) Request(ctx context.Context, r io.Reader) (Results, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Results{}, errors.Wrap(err, "request read error")
+	}
+	req := outgoing{payload: b, reply: make(chan outcome, 1)}
+	select {
+	case rq.out <- req:
+	case <-ctx.Done():
+		return Results{}, ctx.Err()
+	}
+	select {
+	case o := <-req.reply:
+		return o.results, o.err
+	case <-ctx.Done():
+		return Results{}, ctx.Err()
+	}
+}
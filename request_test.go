@@ -0,0 +1,139 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shout answers requests in upper case, failing on "fail" and panicking on "boom"
+func shout(ctx context.Context, sess *Session, r io.Reader) (interface{}, error) {
+	b, _ := io.ReadAll(r)
+	switch msg := string(b); msg {
+	case "fail":
+		return nil, io.ErrUnexpectedEOF
+	case "boom":
+		panic(msg)
+	default:
+		return strings.ToUpper(msg), nil
+	}
+}
+
+func TestRequests(t *testing.T) {
+	for _, codec := range allCodecs {
+		cfg := PusherConfig{
+			Codecs:   []Codec{codec},
+			Requests: shout,
+			PingFreq: testPing,
+			Logger:   FromLogger(logger),
+		}
+		ts := httptest.NewServer(cfg.Pusher(nil))
+
+		requester := NewRequester()
+		client := ClientConfig{Codecs: []Codec{codec}, Requester: requester, Logger: FromLogger(logger)}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Client(ctx, ts.URL, takeX(t, 0, nil))
+		}()
+
+		request := func(msg string) Results {
+			t.Helper()
+			rctx, rcancel := context.WithTimeout(ctx, testTimeout)
+			defer rcancel()
+			results, err := requester.Request(rctx, strings.NewReader(msg))
+			if err != nil {
+				t.Fatal(codec.Name(), err)
+			}
+			return results
+		}
+		var reply string
+		if err := request("hello").Decode(&reply); err != nil || reply != "HELLO" {
+			t.Errorf("%s: answered %q (%v)", codec.Name(), reply, err)
+		}
+		if got := request("fail").ErrMsg; got != io.ErrUnexpectedEOF.Error() {
+			t.Errorf("%s: failure answered with %q", codec.Name(), got)
+		}
+		if got := request("boom").ErrMsg; got != "websox: panic in Requests: boom" {
+			t.Errorf("%s: panic answered with %q", codec.Name(), got)
+		}
+
+		cancel()
+		<-done
+		ts.Close()
+	}
+}
+
+// TestRequestsWithPushes sends requests while the server pushes
+func TestRequestsWithPushes(t *testing.T) {
+	cfg := PusherConfig{
+		Requests: shout,
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(sendX(t, 20)))
+	defer ts.Close()
+
+	requester := NewRequester()
+	client := ClientConfig{Requester: requester, Logger: FromLogger(logger)}
+	handle := func(r io.Reader) (interface{}, bool, error) {
+		io.Copy(io.Discard, r)
+		time.Sleep(time.Millisecond * 10)
+		return nil, true, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Client(context.Background(), ts.URL, handle)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		results, err := requester.Request(ctx, strings.NewReader("again"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := results.Decode(&reply); err != nil || reply != "AGAIN" {
+			t.Errorf("answered %q (%v)", reply, err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the client is gone, so nothing takes the request
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := requester.Request(ctx, strings.NewReader("anyone?")); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error without a connection: %v", err)
+	}
+}
+
+func TestNoRequestHandler(t *testing.T) {
+	hub := &Hub{}
+	cfg := PusherConfig{Hub: hub, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	requester := NewRequester()
+	client := ClientConfig{Requester: requester, Logger: FromLogger(logger)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Client(ctx, ts.URL, takeX(t, 0, nil))
+	}()
+	results, err := requester.Request(ctx, strings.NewReader("hello"))
+	if err != nil || results.ErrMsg != ErrNoHandler.Error() {
+		t.Errorf("answered with %+v (%v)", results, err)
+	}
+	cancel()
+	<-done
+}
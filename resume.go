@@ -0,0 +1,278 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionHeader carries the token of a resumable session,
+	// from the server when connecting and back from the client when reconnecting
+	sessionHeader = "Websox-Session"
+
+	// offsetHeader carries the Offset a reconnecting client has answered up to
+	offsetHeader = "Websox-Offset"
+)
+
+// ErrReplyLost is the error for a push the client answered
+// but whose reply was lost with the connection
+var ErrReplyLost = errors.New("websox: reply lost with connection")
+
+// errResumed ends the connection of a session the client resumed on another
+var errResumed = errors.New("session resumed on another connection")
+
+// stream is the Setup producer of a session and the state of its pushes,
+// which outlives the connection when the session can be resumed
+type stream struct {
+	token     string // identifies a resumable session, empty if not resumable
+	src       chan io.Reader
+	response  chan Results
+	seq       uint64 // the last Seq pushed
+	offset    uint64 // the last Offset pushed
+	inflight  map[uint64]push
+	pending   []Results
+	redeliver []OutboxMessage
+	expires   time.Time // zero never expires
+
+	resumed bool   // the session continues on a new connection
+	acked   uint64 // the Offset the client answered up to before reconnecting
+
+	// guarded by the resumer
+	cancel   context.CancelCauseFunc // ends the connection, nil once detached from it
+	detached chan struct{}           // closed once the connection is done with the session
+	timer    *time.Timer             // ends the session if it is not resumed in time
+}
+
+// newStream returns the stream for a new session,
+// resumable if token is set
+func newStream(src chan io.Reader, response chan Results, token string, expires time.Duration) *stream {
+	st := &stream{
+		token:    token,
+		src:      src,
+		response: response,
+		inflight: make(map[uint64]push),
+	}
+	if expires != 0 {
+		st.expires = time.Now().Add(expires)
+	}
+	return st
+}
+
+// finish ends a session that was not resumed
+func (st *stream) finish(why string) {
+	for seq, p := range st.inflight {
+		p.abandon(seq, why)
+	}
+	if st.response != nil {
+		close(st.response)
+	}
+}
+
+// unanswered returns the Seq of the pushes awaiting replies, in order
+func (st *stream) unanswered() []uint64 {
+	seqs := make([]uint64, 0, len(st.inflight))
+	for seq := range st.inflight {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// resumer tracks the resumable sessions, holding those whose connections
+// failed until their clients reconnect or the grace period passes
+type resumer struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// newResumer returns a resumer, nil if sessions are not resumable
+func newResumer(grace time.Duration) *resumer {
+	if grace <= 0 {
+		return nil
+	}
+	return &resumer{grace: grace, streams: make(map[string]*stream)}
+}
+
+// token returns a new session token, empty if sessions are not resumable
+func (rs *resumer) token() string {
+	if rs == nil {
+		return ""
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// not expected to fail, but if it does sessions are simply not resumable
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// attach records that st is running on a connection ended by cancel
+func (rs *resumer) attach(st *stream, cancel context.CancelCauseFunc) {
+	if rs == nil || st.token == "" {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	st.cancel = cancel
+	st.detached = make(chan struct{})
+	rs.streams[st.token] = st
+}
+
+// detach records that the connection of st is done,
+// keeping st to be resumed if suspended until the grace period passes
+func (rs *resumer) detach(st *stream, suspended bool, logger *slog.Logger) {
+	if rs == nil || st.token == "" {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if st.cancel != nil {
+		st.cancel = nil
+		close(st.detached)
+	}
+	if !suspended {
+		delete(rs.streams, st.token)
+		return
+	}
+	rs.streams[st.token] = st
+	st.timer = time.AfterFunc(rs.grace, func() {
+		rs.mu.Lock()
+		if rs.streams[st.token] != st || st.cancel != nil {
+			rs.mu.Unlock()
+			return
+		}
+		delete(rs.streams, st.token)
+		rs.mu.Unlock()
+		logger.Info("session not resumed", "unanswered", len(st.inflight))
+		st.finish("session not resumed")
+	})
+}
+
+// take returns the session for the client's token,
+// with the Offset it answered up to
+//
+// A session whose failed connection has not been noticed yet
+// is taken from it, which waits a moment for it to be let go
+func (rs *resumer) take(r *http.Request) (*stream, bool) {
+	if rs == nil {
+		return nil, false
+	}
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		return nil, false
+	}
+	rs.mu.Lock()
+	st, ok := rs.streams[token]
+	if ok && st.cancel != nil {
+		cancel, detached := st.cancel, st.detached
+		rs.mu.Unlock()
+		cancel(errResumed)
+		select {
+		case <-detached:
+		case <-time.After(writeWait):
+			return nil, false
+		}
+		rs.mu.Lock()
+		st, ok = rs.streams[token]
+	}
+	if ok && st.cancel == nil {
+		delete(rs.streams, token)
+		st.timer.Stop()
+	} else {
+		ok = false
+	}
+	rs.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	st.resumed = true
+	// a missing or garbled offset has everything replayed
+	st.acked, _ = strconv.ParseUint(r.Header.Get(offsetHeader), 10, 64)
+	return st, true
+}
+
+// resumeState is the session a client resumes when it reconnects
+type resumeState struct {
+	mu    sync.Mutex
+	token string
+	acked uint64              // every Offset up to this one has been answered
+	above map[uint64]struct{} // the answered Offsets past acked
+}
+
+// header adds the session token and answered Offset to the headers for connecting
+func (rs *resumeState) header(headers http.Header) http.Header {
+	if rs == nil {
+		return headers
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.token == "" {
+		return headers
+	}
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set(sessionHeader, rs.token)
+	headers.Set(offsetHeader, strconv.FormatUint(rs.acked, 10))
+	return headers
+}
+
+// connected records the token the server gave the connection,
+// reporting whether it resumed the earlier session
+func (rs *resumeState) connected(token string) bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if token != "" && token == rs.token {
+		return true
+	}
+	rs.token, rs.acked, rs.above = token, 0, nil
+	return false
+}
+
+// ack records that the message at offset has been answered
+func (rs *resumeState) ack(offset uint64) {
+	if rs == nil || offset == 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if offset <= rs.acked {
+		return
+	}
+	if offset > rs.acked+1 {
+		// answered ahead of an earlier message
+		if rs.above == nil {
+			rs.above = make(map[uint64]struct{})
+		}
+		rs.above[offset] = struct{}{}
+		return
+	}
+	rs.acked = offset
+	for {
+		if _, ok := rs.above[rs.acked+1]; !ok {
+			return
+		}
+		delete(rs.above, rs.acked+1)
+		rs.acked++
+	}
+}
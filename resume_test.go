@@ -0,0 +1,225 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dropper is a Dialer whose connections can be dropped without a close frame
+type dropper struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (d *dropper) dialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			d.mu.Lock()
+			d.conn = conn
+			d.mu.Unlock()
+			return conn, err
+		},
+	}
+}
+
+func (d *dropper) drop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn.Close()
+}
+
+// counted is a Setup that pushes msgs, counting the times it is called
+// and sending the Results it gets on all once they are done
+func counted(msgs []string, calls *atomic.Int32, all chan<- []Results) Setup {
+	return func() (chan io.Reader, chan Results) {
+		calls.Add(1)
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			go func() {
+				for _, msg := range msgs {
+					select {
+					case getter <- strings.NewReader(`"` + msg + `"`):
+					case <-time.After(testTimeout):
+						return
+					}
+				}
+				close(getter)
+			}()
+			var got []Results
+			for results := range teller {
+				got = append(got, results)
+			}
+			all <- got
+		}()
+		return getter, teller
+	}
+}
+
+func TestResume(t *testing.T) {
+	var calls atomic.Int32
+	all := make(chan []Results, 1)
+	msgs := []string{"a", "b", "c", "d", "e"}
+	cfg := PusherConfig{
+		Window:      2,
+		PingFreq:    testPing,
+		ResumeGrace: testTimeout,
+		Logger:      FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(counted(msgs, &calls, all)))
+	defer ts.Close()
+
+	// the connection is lost while handling "c" the first time
+	d := &dropper{}
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	action := func(r io.Reader) (interface{}, bool, error) {
+		msg := decoded(t, r)
+		mu.Lock()
+		handled = append(handled, msg)
+		first := len(handled) == 3
+		mu.Unlock()
+		if first {
+			d.drop()
+		}
+		return msg, true, nil
+	}
+	client := ClientConfig{Dialer: d.dialer(), Resume: true, Logger: FromLogger(logger)}
+	policy := ReconnectPolicy{Initial: time.Millisecond * 10, StopOnClose: true}
+	if err := client.Reconnect(context.Background(), ts.URL, action, nil, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-all
+	if calls.Load() != 1 {
+		t.Errorf("setup called %d times", calls.Load())
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("got %d results -- expected %d: %+v", len(got), len(msgs), got)
+	}
+	for _, results := range got {
+		var reply string
+		if err := results.Decode(&reply); err != nil || reply != msgs[results.Seq-1] {
+			t.Errorf("message %d answered with %q (%v)", results.Seq, reply, err)
+		}
+	}
+	// "c" went unanswered, so it is handled again along with whatever followed it
+	if strings.Join(handled[:3], "") != "abc" || !strings.Contains(strings.Join(handled[3:], ""), "c") {
+		t.Errorf("handled: %q", handled)
+	}
+}
+
+func TestResumeGraceExpired(t *testing.T) {
+	var calls atomic.Int32
+	all := make(chan []Results, 1)
+	metrics := endings{ended: make(chan string, 2)}
+	cfg := PusherConfig{
+		PingFreq:    testPing,
+		ResumeGrace: time.Millisecond * 20,
+		Metrics:     metrics,
+		Logger:      FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(counted([]string{"a", "b"}, &calls, all)))
+	defer ts.Close()
+
+	d := &dropper{}
+	action := func(r io.Reader) (interface{}, bool, error) {
+		d.drop()
+		return decoded(t, r), true, nil
+	}
+	client := ClientConfig{Dialer: d.dialer(), Resume: true, Logger: FromLogger(logger)}
+	if err := client.Client(context.Background(), ts.URL, action); err == nil {
+		t.Error("connection was not dropped")
+	}
+
+	// the producer is done with once the client fails to return
+	select {
+	case got := <-all:
+		if len(got) != 0 {
+			t.Errorf("got results: %+v", got)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("session did not end")
+	}
+	if reason := <-metrics.ended; reason != EndSuspended {
+		t.Errorf("session ended with: %q", reason)
+	}
+
+	// the token is no longer any good, so the client gets a new session
+	client.resumed = &resumeState{token: "expired"}
+	action = func(r io.Reader) (interface{}, bool, error) {
+		return decoded(t, r), true, nil
+	}
+	if err := client.Client(context.Background(), ts.URL, action); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-all; len(got) != 2 || calls.Load() != 2 {
+		t.Errorf("setup called %d times for results: %+v", calls.Load(), got)
+	}
+	if client.resumed.token == "expired" || client.resumed.acked != 2 {
+		t.Errorf("resume state: %+v", client.resumed)
+	}
+}
+
+// TestResumeTakeover resumes a session whose connection is still thought to be live
+func TestResumeTakeover(t *testing.T) {
+	rs := newResumer(testTimeout)
+	st := newStream(nil, nil, rs.token(), 0)
+	rs.attach(st, func(cause error) {
+		go rs.detach(st, cause == errResumed, FromLogger(logger))
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(sessionHeader, st.token)
+	r.Header.Set(offsetHeader, "4")
+	if got, ok := rs.take(r); !ok || got != st || !st.resumed || st.acked != 4 {
+		t.Fatalf("session not taken over: %v", ok)
+	}
+	if _, ok := rs.take(r); ok {
+		t.Error("session taken twice")
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	var rs resumeState
+	if h := rs.header(nil); h != nil {
+		t.Errorf("headers without a session: %v", h)
+	}
+	if rs.connected("t1") {
+		t.Error("first connection resumed")
+	}
+	for _, offset := range []uint64{1, 3, 5, 2} {
+		rs.ack(offset)
+	}
+	h := rs.header(http.Header{"X-Other": {"x"}})
+	if h.Get(sessionHeader) != "t1" || h.Get(offsetHeader) != "3" || h.Get("X-Other") != "x" {
+		t.Errorf("headers: %v", h)
+	}
+	if !rs.connected("t1") || rs.acked != 3 {
+		t.Errorf("session not resumed, acked %d", rs.acked)
+	}
+	rs.ack(4)
+	if rs.acked != 5 || len(rs.above) != 0 {
+		t.Errorf("acked %d with %v ahead", rs.acked, rs.above)
+	}
+	if rs.connected("t2") || rs.acked != 0 || rs.above != nil {
+		t.Errorf("new session kept state, acked %d with %v ahead", rs.acked, rs.above)
+	}
+}
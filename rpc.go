@@ -0,0 +1,214 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// rpcVersion is the JSON-RPC version of every request and response
+const rpcVersion = "2.0"
+
+// RPCError is a JSON-RPC 2.0 error object
+//
+// Call returns the errors of client methods as an *RPCError,
+// and a MethodHandler may return one to choose the code sent
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("websox: rpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcRequest is a JSON-RPC 2.0 request object, a notification if it has no ID
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response object
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Call invokes method on the client with params and returns its result
+//
+// The call is pushed to the client as a JSON-RPC 2.0 request, which a client
+// answers with a Router. The result is the JSON of the response, and an error
+// from the method is returned as an *RPCError. If ctx has no deadline the call
+// is limited by the Hub's CallTimeout. JSON-RPC needs a connection Codec
+// other than websoxproto's
+func (s *Session) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	req := rpcRequest{JSONRPC: rpcVersion, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return nil, errors.Wrap(err, "params encode error")
+		}
+		req.Params = b
+	}
+	id := strconv.FormatUint(s.calls.Add(1), 10)
+	req.ID = json.RawMessage(id)
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request encode error")
+	}
+
+	if _, ok := ctx.Deadline(); !ok && s.hub.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.hub.CallTimeout)
+		defer cancel()
+	}
+	results, err := s.Send(ctx, msg)
+	switch {
+	case err != nil:
+		return nil, err
+	case results.TimedOut():
+		return nil, ErrReplyTimeout
+	case results.ErrMsg != "":
+		return nil, errors.New(results.ErrMsg)
+	}
+
+	// the response is JSON whatever the connection's codec
+	var raw json.RawMessage
+	if err := results.Decode(&raw); err != nil {
+		return nil, errors.Wrap(err, "response decode error")
+	}
+	var resp rpcResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, errors.Wrap(err, "response decode error")
+	}
+	if string(resp.ID) != id {
+		return nil, errors.Errorf("response id %s does not match call %s", resp.ID, id)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// Call invokes method on the client of session id, see Session.Call
+func (h *Hub) Call(ctx context.Context, id uint64, method string, params interface{}) (json.RawMessage, error) {
+	s, ok := h.Session(id)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return s.Call(ctx, method, params)
+}
+
+// MethodHandler runs a client method called by the server,
+// returning the result to send back
+//
+// ctx is that of the message, see ReaderContext
+type MethodHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// Router answers the JSON-RPC calls made with Session.Call,
+// running the handler registered for each method
+//
+// Its Actionable is given to a Client in place of a single Actionable
+type Router struct {
+	// Fallback handles messages that are not JSON-RPC requests,
+	// which are answered with a parse error if nil
+	Fallback Actionable
+
+	mu      sync.RWMutex
+	methods map[string]MethodHandler
+}
+
+// NewRouter returns a Router without any methods
+func NewRouter() *Router {
+	return &Router{methods: make(map[string]MethodHandler)}
+}
+
+// Handle registers the handler for method, replacing any before it
+func (rt *Router) Handle(method string, handler MethodHandler) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.methods[method] = handler
+}
+
+// Actionable returns the Actionable that dispatches calls to their methods
+func (rt *Router) Actionable() Actionable {
+	return func(r io.Reader) (interface{}, bool, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, true, err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(b, &req); err != nil || req.JSONRPC != rpcVersion {
+			if rt.Fallback != nil {
+				return rt.Fallback(contextReader{Reader: bytes.NewReader(b), ctx: ReaderContext(r), topic: ReaderTopic(r), id: ReaderID(r)})
+			}
+			return rt.respond(nil, nil, &RPCError{Code: CodeParseError, Message: "not a JSON-RPC request"}), true, nil
+		}
+		if req.Method == "" {
+			return rt.respond(req.ID, nil, &RPCError{Code: CodeInvalidRequest, Message: "no method"}), true, nil
+		}
+
+		rt.mu.RLock()
+		handler, ok := rt.methods[req.Method]
+		rt.mu.RUnlock()
+		if !ok {
+			return rt.respond(req.ID, nil, &RPCError{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}), true, nil
+		}
+
+		result, err := handler(ReaderContext(r), req.Params)
+		if req.ID == nil {
+			// notifications are not answered
+			return nil, true, nil
+		}
+		return rt.respond(req.ID, result, err), true, nil
+	}
+}
+
+// respond returns the JSON of the response to the request with id
+func (rt *Router) respond(id json.RawMessage, result interface{}, err error) json.RawMessage {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp := rpcResponse{JSONRPC: rpcVersion, ID: id}
+	if err == nil {
+		b, merr := json.Marshal(result)
+		if merr != nil {
+			err = &RPCError{Code: CodeInternalError, Message: "result encode error: " + merr.Error()}
+		}
+		resp.Result = b
+	}
+	if err != nil {
+		resp.Result = nil
+		rerr, ok := err.(*RPCError)
+		if !ok {
+			rerr = &RPCError{Code: CodeInternalError, Message: err.Error()}
+		}
+		resp.Error = rerr
+	}
+	b, _ := json.Marshal(resp)
+	return b
+}
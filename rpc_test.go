@@ -0,0 +1,139 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcClient connects a client answering calls with the router
+func rpcClient(ctx context.Context, url string, codec Codec, router *Router) <-chan error {
+	cfg := ClientConfig{Codecs: []Codec{codec}, Logger: FromLogger(logger)}
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.Client(ctx, url, router.Actionable())
+	}()
+	return done
+}
+
+func TestCall(t *testing.T) {
+	router := NewRouter()
+	router.Handle("add", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var args []int
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, &RPCError{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		sum := 0
+		for _, n := range args {
+			sum += n
+		}
+		return sum, nil
+	})
+	router.Handle("fail", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+
+	for _, codec := range allCodecs {
+		hub := &Hub{}
+		cfg := PusherConfig{Hub: hub, Codecs: []Codec{codec}, PingFreq: testPing, Logger: FromLogger(logger)}
+		ts := httptest.NewServer(cfg.Pusher(nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := rpcClient(ctx, ts.URL, codec, router)
+		id := waitSessions(t, hub, 1)[0].ID
+
+		result, err := hub.Call(ctx, id, "add", []int{1, 2, 3})
+		if err != nil || string(result) != "6" {
+			t.Errorf("%s: add returned %s (%v)", codec.Name(), result, err)
+		}
+
+		expect := map[string]int{
+			"add":     CodeInvalidParams,
+			"fail":    CodeInternalError,
+			"missing": CodeMethodNotFound,
+		}
+		for method, code := range expect {
+			_, err := hub.Call(ctx, id, method, "nonsense")
+			if rerr, ok := err.(*RPCError); !ok || rerr.Code != code {
+				t.Errorf("%s: %s returned %v -- expected code %d", codec.Name(), method, err, code)
+			}
+		}
+
+		cancel()
+		<-done
+		ts.Close()
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	router := NewRouter()
+	router.Handle("sleep", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		time.Sleep(time.Millisecond * 100)
+		return nil, nil
+	})
+	hub := &Hub{CallTimeout: time.Millisecond * 20}
+	cfg := PusherConfig{Hub: hub, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := rpcClient(ctx, ts.URL, JSON, router)
+	id := waitSessions(t, hub, 1)[0].ID
+
+	if _, err := hub.Call(ctx, id, "sleep", nil); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a deadline of the call's own replaces the hub's
+	cctx, ccancel := context.WithTimeout(ctx, testTimeout)
+	defer ccancel()
+	result, err := hub.Call(cctx, id, "sleep", nil)
+	if err != nil || string(result) != "null" {
+		t.Errorf("sleep returned %s (%v)", result, err)
+	}
+
+	if _, err := hub.Call(ctx, id+1, "sleep", nil); err != ErrNoSession {
+		t.Errorf("unexpected error without a session: %v", err)
+	}
+	cancel()
+	<-done
+}
+
+func TestRouterFallback(t *testing.T) {
+	router := NewRouter()
+	router.Handle("ping", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	})
+	action := router.Actionable()
+
+	// plain messages fail to parse without a Fallback
+	reply, _, err := action(Stuff{Msg: "plain"}.NewReader())
+	var resp rpcResponse
+	if err != nil || json.Unmarshal(reply.(json.RawMessage), &resp) != nil ||
+		resp.Error == nil || resp.Error.Code != CodeParseError || string(resp.ID) != "null" {
+		t.Errorf("plain message answered with %s (%v)", reply, err)
+	}
+
+	router.Fallback = func(r io.Reader) (interface{}, bool, error) {
+		var stuff Stuff
+		err := json.NewDecoder(r).Decode(&stuff)
+		return stuff.Msg, true, err
+	}
+	if reply, _, err := action(Stuff{Msg: "plain"}.NewReader()); err != nil || reply != "plain" {
+		t.Errorf("fallback answered with %v (%v)", reply, err)
+	}
+
+	// notifications are run but not answered
+	reply, _, err = action(strings.NewReader(`{"jsonrpc":"2.0","method":"ping"}`))
+	if err != nil || reply != nil {
+		t.Errorf("notification answered with %v (%v)", reply, err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// topicsHeader carries the topics a client subscribes to when connecting
+	topicsHeader = "Websox-Topics"
+)
+
+// ErrBadTopic is returned when subscribing to a malformed topic pattern
+var ErrBadTopic = errors.New("websox: bad topic pattern")
+
+// Subscription changes the topics a client receives messages for
+//
+// Topics are dot separated names such as "orders.eu.created".
+// Subscriptions are topic patterns in which "*" matches any single name
+// and a final ">" matches one or more names, so "orders.*.created"
+// and "orders.>" both match "orders.eu.created"
+type Subscription struct {
+	Subscribe   []string `json:"subscribe,omitempty" proto:"1"`
+	Unsubscribe []string `json:"unsubscribe,omitempty" proto:"2"`
+}
+
+// TopicStats counts the messages published to a topic through a Hub
+type TopicStats struct {
+	Published int64 // messages published to the topic
+	Unrouted  int64 // messages that no session was subscribed to
+	Delivered int64 // replies without an error
+	Failed    int64 // failed deliveries and replies with an error
+}
+
+// validTopic reports whether pattern is a well formed topic pattern
+func validTopic(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	names := strings.Split(pattern, ".")
+	for i, name := range names {
+		switch {
+		case name == "":
+			return false
+		case name == ">" && i != len(names)-1:
+			return false
+		case name != "*" && name != ">" && strings.ContainsAny(name, "*>"):
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatch reports whether topic matches the subscription pattern
+func topicMatch(pattern, topic string) bool {
+	names := strings.Split(topic, ".")
+	for i, want := range strings.Split(pattern, ".") {
+		if want == ">" {
+			return len(names) > i
+		}
+		if i >= len(names) || (want != "*" && want != names[i]) {
+			return false
+		}
+	}
+	return len(names) == len(strings.Split(pattern, "."))
+}
+
+// parseTopics returns the valid patterns from a topics header
+func parseTopics(header string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(header, ",") {
+		if pattern = strings.TrimSpace(pattern); validTopic(pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Subscribe adds topic patterns to a session
+func (h *Hub) Subscribe(id uint64, patterns ...string) error {
+	for _, pattern := range patterns {
+		if !validTopic(pattern) {
+			return errors.Wrap(ErrBadTopic, pattern)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	for _, pattern := range patterns {
+		s.topics[pattern] = struct{}{}
+	}
+	return nil
+}
+
+// Unsubscribe removes topic patterns from a session
+func (h *Hub) Unsubscribe(id uint64, patterns ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	for _, pattern := range patterns {
+		delete(s.topics, pattern)
+	}
+	return nil
+}
+
+// subscription applies a Subscription sent by the client of a session
+func (h *Hub) subscription(id uint64, sub Subscription) error {
+	if err := h.Unsubscribe(id, sub.Unsubscribe...); err != nil {
+		return err
+	}
+	return h.Subscribe(id, sub.Subscribe...)
+}
+
+// Publish pushes msg to every session subscribed to topic and waits for their replies
+func (h *Hub) Publish(ctx context.Context, topic string, msg []byte) Report {
+	report := h.sendAll(ctx, topic, msg, func(s *Session) bool {
+		for pattern := range s.topics {
+			if topicMatch(pattern, topic) {
+				return true
+			}
+		}
+		return false
+	})
+
+	h.mu.Lock()
+	if h.stats == nil {
+		h.stats = make(map[string]*TopicStats)
+	}
+	stats, ok := h.stats[topic]
+	if !ok {
+		stats = &TopicStats{}
+		h.stats[topic] = stats
+	}
+	stats.Published++
+	if len(report.Results) == 0 {
+		stats.Unrouted++
+	}
+	stats.Failed += int64(report.Failed)
+	stats.Delivered += int64(len(report.Results) - report.Failed)
+	h.mu.Unlock()
+	return report
+}
+
+// TopicStats returns the delivery counts of each topic published to
+func (h *Hub) TopicStats() map[string]TopicStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stats := make(map[string]TopicStats, len(h.stats))
+	for topic, s := range h.stats {
+		stats[topic] = *s
+	}
+	return stats
+}
+
+// ReaderTopic returns the topic a message received by an Actionable
+// was published to, or "" if it was not published to a topic
+func ReaderTopic(r io.Reader) string {
+	if cr, ok := r.(contextReader); ok {
+		return cr.topic
+	}
+	return ""
+}
+
+// topicSet tracks the subscriptions of a client across connections
+type topicSet struct {
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+func newTopicSet(patterns []string) *topicSet {
+	ts := &topicSet{topics: make(map[string]struct{})}
+	ts.apply(Subscription{Subscribe: patterns})
+	return ts
+}
+
+func (ts *topicSet) apply(sub Subscription) {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, pattern := range sub.Unsubscribe {
+		delete(ts.topics, pattern)
+	}
+	for _, pattern := range sub.Subscribe {
+		ts.topics[pattern] = struct{}{}
+	}
+}
+
+// header adds the subscribed topics to the headers for connecting
+func (ts *topicSet) header(headers http.Header) http.Header {
+	if ts == nil {
+		return headers
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.topics) == 0 {
+		return headers
+	}
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set(topicsHeader, strings.Join(sortedKeys(ts.topics), ","))
+	return headers
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, topic string
+		expected       bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.eu", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{">", "anything.at.all", true},
+		{"*.eu", "orders.eu", true},
+	} {
+		if got := topicMatch(test.pattern, test.topic); got != test.expected {
+			t.Errorf("pattern %q topic %q matched: %t -- expected: %t", test.pattern, test.topic, got, test.expected)
+		}
+	}
+
+	for pattern, expected := range map[string]bool{
+		"orders.*.created": true,
+		"orders.>":         true,
+		"":                 false,
+		"orders..created":  false,
+		"orders.>.created": false,
+		"orders.eu*":       false,
+	} {
+		if got := validTopic(pattern); got != expected {
+			t.Errorf("pattern %q valid: %t -- expected: %t", pattern, got, expected)
+		}
+	}
+}
+
+// topicClient replies to every message with its name and the topic of the message
+func topicClient(ctx context.Context, url, name string, topics []string, subs <-chan Subscription) <-chan error {
+	cfg := ClientConfig{
+		Topics:        topics,
+		Subscriptions: subs,
+		Logger:        FromLogger(logger),
+	}
+	action := func(r io.Reader) (interface{}, bool, error) {
+		io.Copy(io.Discard, r)
+		return name + ":" + ReaderTopic(r), true, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.Client(ctx, url, action)
+	}()
+	return done
+}
+
+// waitTopics waits until the session has the given subscriptions
+func waitTopics(t *testing.T, hub *Hub, id uint64, topics ...string) {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		s, ok := hub.Session(id)
+		if !ok {
+			t.Fatalf("no session %d", id)
+		}
+		got := s.Info().Topics
+		if reflect.DeepEqual(got, topics) || (len(got) == 0 && len(topics) == 0) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %d has topics %q -- expected %q", id, got, topics)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	hub := &Hub{}
+	cfg := PusherConfig{
+		Hub:      hub,
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subs := make(chan Subscription)
+	clients := []<-chan error{
+		topicClient(ctx, ts.URL, "alice", []string{"orders.>"}, nil),
+		topicClient(ctx, ts.URL, "bob", []string{"orders.*.created", "alerts.*"}, nil),
+		topicClient(ctx, ts.URL, "carol", nil, subs),
+	}
+	infos := waitSessions(t, hub, len(clients))
+
+	ids := make(map[string]uint64)
+	for _, info := range infos {
+		switch len(info.Topics) {
+		case 0:
+			ids["carol"] = info.ID
+		case 1:
+			ids["alice"] = info.ID
+		case 2:
+			ids["bob"] = info.ID
+		}
+	}
+
+	publish := func(topic string, expected ...string) {
+		t.Helper()
+		report := hub.Publish(ctx, topic, []byte(`"news"`))
+		got := make(map[string]bool)
+		for _, results := range report.Results {
+			var reply string
+			if err := results.Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			got[reply] = true
+		}
+		want := make(map[string]bool)
+		for _, name := range expected {
+			want[name+":"+topic] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("publish to %s reached %v -- expected %v", topic, got, want)
+		}
+	}
+
+	publish("orders.eu.created", "alice", "bob")
+	publish("orders.eu.deleted", "alice")
+	publish("alerts.fire", "bob")
+	publish("weather")
+
+	// subscriptions sent by the client
+	subs <- Subscription{Subscribe: []string{"alerts.>", "weather"}}
+	waitTopics(t, hub, ids["carol"], "alerts.>", "weather")
+	publish("alerts.fire", "bob", "carol")
+
+	subs <- Subscription{Unsubscribe: []string{"alerts.>"}}
+	waitTopics(t, hub, ids["carol"], "weather")
+	publish("alerts.fire", "bob")
+
+	// and by the server
+	if err := hub.Unsubscribe(ids["bob"], "alerts.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Subscribe(ids["alice"], "weather"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Subscribe(ids["alice"], "bad..pattern"); err == nil {
+		t.Error("expected bad pattern error")
+	}
+	publish("alerts.fire")
+	publish("weather", "alice", "carol")
+
+	stats := hub.TopicStats()
+	expected := map[string]TopicStats{
+		"orders.eu.created": {Published: 1, Delivered: 2},
+		"orders.eu.deleted": {Published: 1, Delivered: 1},
+		"alerts.fire":       {Published: 4, Unrouted: 1, Delivered: 4},
+		"weather":           {Published: 2, Unrouted: 1, Delivered: 2},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("topic stats: %+v -- expected %+v", stats, expected)
+	}
+
+	cancel()
+	for _, done := range clients {
+		<-done
+	}
+}
+
+// TestReconnectTopics checks that subscription changes outlive a connection
+func TestReconnectTopics(t *testing.T) {
+	hub := &Hub{}
+	cfg := PusherConfig{
+		Hub:      hub,
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(nil))
+	defer ts.Close()
+
+	subs := make(chan Subscription)
+	client := ClientConfig{Topics: []string{"a"}, Subscriptions: subs}.defaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Client(ctx, ts.URL, takeX(t, 0, nil))
+	}()
+	id := waitSessions(t, hub, 1)[0].ID
+	subs <- Subscription{Subscribe: []string{"b"}, Unsubscribe: []string{"a"}}
+	waitTopics(t, hub, id, "b")
+	cancel()
+	<-done
+	waitSessions(t, hub, 0)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		done <- client.Client(ctx, ts.URL, takeX(t, 0, nil))
+	}()
+	waitTopics(t, hub, waitSessions(t, hub, 1)[0].ID, "b")
+}
+
+func TestUpstreamEncoding(t *testing.T) {
+	sub := upstream{Subscription: &Subscription{Subscribe: []string{"a.*", "b.>"}, Unsubscribe: []string{"c"}}}
+	env := envelope{Seq: 9, Topic: "orders.eu.created", ID: "0001", Request: 3, Error: "no", Offset: 12}
+	req := upstream{Request: &request{ID: 3, Payload: []byte("ask")}}
+	for _, codec := range allCodecs {
+		b, err := codec.Marshal(sub)
+		if err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		var got upstream
+		if err := codec.Unmarshal(b, &got); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if !reflect.DeepEqual(got.Subscription, sub.Subscription) || got.Request != nil {
+			t.Errorf("%s subscription: %+v -- expected %+v", codec.Name(), got.Subscription, sub.Subscription)
+		}
+
+		if b, err = codec.Marshal(req); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		got = upstream{}
+		if err := codec.Unmarshal(b, &got); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if !reflect.DeepEqual(got.Request, req.Request) || got.Subscription != nil {
+			t.Errorf("%s request: %+v -- expected %+v", codec.Name(), got.Request, req.Request)
+		}
+
+		// plain Results decode as upstream messages without a subscription
+		results := Results{Seq: 4, ErrMsg: "oops", ID: "0002"}
+		if b, err = codec.Marshal(results); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		got = upstream{}
+		if err := codec.Unmarshal(b, &got); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if got.Subscription != nil || got.Seq != 4 || got.ErrMsg != "oops" || got.ID != "0002" {
+			t.Errorf("%s results decoded as: %+v", codec.Name(), got)
+		}
+
+		if b, err = codec.Marshal(env); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		var gotEnv envelope
+		if err := codec.Unmarshal(b, &gotEnv); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if gotEnv.Topic != env.Topic || gotEnv.ID != env.ID || gotEnv.Request != env.Request || gotEnv.Error != env.Error {
+			t.Errorf("%s envelope: %+v -- expected %+v", codec.Name(), gotEnv, env)
+		}
+	}
+}
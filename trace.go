@@ -0,0 +1,160 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName identifies the spans created by websox
+	tracerName = "github.com/paulstuart/websox"
+)
+
+// Tracing configures OpenTelemetry spans for each push and its reply
+//
+// The trace context of a push is carried in its frame envelope,
+// so the client span that handles it is a child of the server span
+type Tracing struct {
+	// Provider creates the spans, tracing is disabled if nil
+	Provider trace.TracerProvider
+
+	// Propagator encodes the trace context, W3C Trace Context if nil
+	Propagator propagation.TextMapPropagator
+}
+
+// SpanStatus reports the client span that handled a push
+type SpanStatus struct {
+	TraceID string `json:"trace_id" proto:"1"`
+	SpanID  string `json:"span_id" proto:"2"`
+	Code    string `json:"code" proto:"3"` // "Ok" or "Error"
+}
+
+func (t Tracing) enabled() bool {
+	return t.Provider != nil
+}
+
+func (t Tracing) propagator() propagation.TextMapPropagator {
+	if t.Propagator == nil {
+		return propagation.TraceContext{}
+	}
+	return t.Propagator
+}
+
+// startPush starts the span for a push, adding its trace context to env
+func (t Tracing) startPush(ctx context.Context, env *envelope) trace.Span {
+	if !t.enabled() {
+		return nil
+	}
+	ctx, span := t.Provider.Tracer(tracerName).Start(ctx, "websox.push",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.Int64("websox.seq", int64(env.Seq))),
+	)
+	carrier := propagation.MapCarrier{}
+	t.propagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		env.Trace = carrier
+	}
+	return span
+}
+
+// endPush ends a push span with the outcome of its reply
+func endPush(span trace.Span, results Results) {
+	if span == nil {
+		return
+	}
+	if s := results.Span; s != nil {
+		span.SetAttributes(
+			attribute.String("websox.client.trace_id", s.TraceID),
+			attribute.String("websox.client.span_id", s.SpanID),
+		)
+	}
+	if results.ErrMsg != "" {
+		span.SetStatus(codes.Error, results.ErrMsg)
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
+
+// startAction starts the client span for handling a push,
+// as a child of the trace context in env
+func (t Tracing) startAction(ctx context.Context, env envelope) (context.Context, trace.Span) {
+	if !t.enabled() {
+		return ctx, nil
+	}
+	if len(env.Trace) > 0 {
+		ctx = t.propagator().Extract(ctx, propagation.MapCarrier(env.Trace))
+	}
+	return t.Provider.Tracer(tracerName).Start(ctx, "websox.action",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.Int64("websox.seq", int64(env.Seq))),
+	)
+}
+
+// endAction ends the client span with the outcome of the Actionable
+func endAction(span trace.Span, err error) *SpanStatus {
+	if span == nil {
+		return nil
+	}
+	code := codes.Ok
+	if err != nil {
+		span.RecordError(err)
+		code = codes.Error
+		span.SetStatus(code, err.Error())
+	} else {
+		span.SetStatus(code, "")
+	}
+	span.End()
+
+	sc := span.SpanContext()
+	return &SpanStatus{
+		TraceID: sc.TraceID().String(),
+		SpanID:  sc.SpanID().String(),
+		Code:    code.String(),
+	}
+}
+
+// contextReader is a message with an associated context
+//
+// Messages received by a client also have the topic they were published to
+// and their Outbox message ID
+type contextReader struct {
+	io.Reader
+	ctx   context.Context
+	topic string
+	id    string
+}
+
+// WithContext associates ctx with r
+//
+// Messages sent on a Setup channel this way have their push spans
+// started as children of any span in ctx. The Actionable on the client
+// gets messages with the context of their span, see ReaderContext
+func WithContext(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{Reader: r, ctx: ctx}
+}
+
+// ReaderContext returns the context associated with r by WithContext,
+// or context.Background() if there is none
+func ReaderContext(r io.Reader) context.Context {
+	if ctx, ok := readerContext(r); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+func readerContext(r io.Reader) (context.Context, bool) {
+	if cr, ok := r.(contextReader); ok && cr.ctx != nil {
+		return cr.ctx, true
+	}
+	return nil, false
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracing := Tracing{Provider: provider}
+
+	// the producer's span is the parent of the push spans
+	parent, root := provider.Tracer("test").Start(context.Background(), "producer")
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			defer close(getter)
+			for i := 0; i < 2; i++ {
+				getter <- WithContext(parent, Stuff{Count: i}.NewReader())
+				if results := <-teller; results.Span == nil {
+					t.Error("no span status in results")
+				}
+			}
+		}()
+		return getter, teller
+	}
+
+	cfg := PusherConfig{
+		PingFreq: testPing,
+		Tracing:  tracing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	var count int
+	action := func(r io.Reader) (interface{}, bool, error) {
+		count++
+		if !trace.SpanContextFromContext(ReaderContext(r)).IsValid() {
+			t.Error("no span in reader context")
+		}
+		if count == 2 {
+			return nil, true, errors.New("second thoughts")
+		}
+		return nil, true, nil
+	}
+	clientCfg := ClientConfig{Tracing: tracing, Logger: FromLogger(logger)}
+	if err := clientCfg.Client(context.Background(), ts.URL, action); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	pushes := make(map[trace.SpanID]sdktrace.ReadOnlySpan)
+	var actions []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "websox.push":
+			pushes[span.SpanContext().SpanID()] = span
+			if span.Parent().SpanID() != root.SpanContext().SpanID() {
+				t.Error("push span is not a child of the producer span")
+			}
+		case "websox.action":
+			actions = append(actions, span)
+		}
+	}
+	if len(pushes) != 2 || len(actions) != 2 {
+		t.Fatalf("got %d push spans and %d action spans -- expected 2 of each", len(pushes), len(actions))
+	}
+	for i, action := range actions {
+		push, ok := pushes[action.Parent().SpanID()]
+		if !ok {
+			t.Fatalf("action span %d is not a child of a push span", i)
+		}
+		if action.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("action span %d is in a different trace", i)
+		}
+		expected := codes.Ok
+		if i == 1 {
+			expected = codes.Error
+		}
+		if action.Status().Code != expected || push.Status().Code != expected {
+			t.Errorf("span %d status -- action: %v push: %v expected: %v", i, action.Status().Code, push.Status().Code, expected)
+		}
+	}
+}
+
+func TestTraceEncoding(t *testing.T) {
+	env := envelope{
+		Seq:   3,
+		Trace: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+	results := Results{
+		Seq:  3,
+		Span: &SpanStatus{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "00f067aa0ba902b7", Code: "Ok"},
+	}
+	for _, codec := range allCodecs {
+		b, err := codec.Marshal(env)
+		if err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		var gotEnv envelope
+		if err := codec.Unmarshal(b, &gotEnv); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if !reflect.DeepEqual(env, gotEnv) {
+			t.Errorf("%s envelope: %+v -- expected %+v", codec.Name(), gotEnv, env)
+		}
+
+		if b, err = codec.Marshal(results); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		var got Results
+		if err := codec.Unmarshal(b, &got); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if got.Span == nil || *got.Span != *results.Span {
+			t.Errorf("%s span: %+v -- expected %+v", codec.Name(), got.Span, results.Span)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Result is the typed counterpart of Results
+//
+// Seq is zero for a value that could not be encoded and was never sent
+type Result[R any] struct {
+	Seq    uint64
+	Value  R
+	ErrMsg string
+}
+
+// TypedSetup returns a channel of values to push and one that returns
+// the decoded client replies, following the same rules as Setup
+type TypedSetup[T, R any] func() (chan T, chan Result[R])
+
+// TypedActionable functions process a decoded value and return
+// a reply for the server,
+// a bool set false if to close the client,
+// and an error if such is encountered
+type TypedActionable[T, R any] func(T) (R, bool, error)
+
+// TypedPusher is a Pusher for values of T that are answered by values of R
+func TypedPusher[T, R any](setup TypedSetup[T, R], expires, pingFreq time.Duration, contacted func(), logger *log.Logger) http.HandlerFunc {
+	return Pusher(setup.Setup(), expires, pingFreq, contacted, logger)
+}
+
+// TypedClient is a Client that decodes each message into a T for fn
+func TypedClient[T, R any](url string, fn TypedActionable[T, R], pings bool, headers http.Header, logger *log.Logger) error {
+	return Client(url, fn.Actionable(), pings, headers, logger)
+}
+
+// Setup adapts the typed setup for use with any of the Pusher functions
+// by JSON encoding the values sent and decoding the replies received
+func (setup TypedSetup[T, R]) Setup() Setup {
+	return setup.SetupCodec(JSON)
+}
+
+// SetupCodec is Setup with values encoded by codec
+//
+// Replies are decoded with whichever codec the session negotiated
+func (setup TypedSetup[T, R]) SetupCodec(codec Codec) Setup {
+	return func() (chan io.Reader, chan Results) {
+		values, typed := setup()
+		if values == nil {
+			// the producer's channel is closed after a failure, as with Setup
+			result := <-typed
+			close(typed)
+			teller := make(chan Results, 1)
+			teller <- Results{ErrMsg: result.ErrMsg}
+			return nil, teller
+		}
+
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		failed := make(chan Result[R])
+		done := make(chan struct{})
+
+		go func() {
+			defer close(getter)
+			for v := range values {
+				b, err := codec.Marshal(v)
+				if err != nil {
+					select {
+					case failed <- Result[R]{ErrMsg: "encode error: " + err.Error()}:
+						continue
+					case <-done:
+						return
+					}
+				}
+				select {
+				case getter <- bytes.NewReader(b):
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		// the only writer of typed, so it can be closed safely
+		go func() {
+			defer close(typed)
+			defer close(done)
+			for {
+				var result Result[R]
+				select {
+				case result = <-failed:
+				case results, ok := <-teller:
+					if !ok {
+						return
+					}
+					result = Result[R]{Seq: results.Seq, ErrMsg: results.ErrMsg}
+					if results.Payload != nil {
+						if err := results.Decode(&result.Value); err != nil && result.ErrMsg == "" {
+							result.ErrMsg = "decode error: " + err.Error()
+						}
+					}
+				}
+				typed <- result
+			}
+		}()
+
+		return getter, teller
+	}
+}
+
+// Actionable adapts the typed function for use with any of the Client functions
+//
+// A message that cannot be decoded is reported back to the server as an error
+func (fn TypedActionable[T, R]) Actionable() Actionable {
+	return fn.ActionableCodec(JSON)
+}
+
+// ActionableCodec is Actionable for values encoded by codec
+func (fn TypedActionable[T, R]) ActionableCodec(codec Codec) Actionable {
+	return func(r io.Reader) (interface{}, bool, error) {
+		var v T
+		b, err := io.ReadAll(r)
+		if err == nil {
+			err = codec.Unmarshal(b, &v)
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		reply, ok, err := fn(v)
+		return reply, ok, err
+	}
+}
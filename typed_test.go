@@ -0,0 +1,132 @@
+package websox
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func fizzbuzz(s Stuff) (string, bool, error) {
+	three := s.Count%3 == 0
+	five := s.Count%5 == 0
+	switch {
+	case three && five:
+		return "fizzbuzz", true, nil
+	case three:
+		return "fizz", true, nil
+	case five:
+		return "buzz", true, nil
+	}
+	return "", true, fmt.Errorf("plain %d", s.Count)
+}
+
+func TestTyped(t *testing.T) {
+	const limit = 15
+
+	done := make(chan []Result[string], 1)
+	sender := func() (chan Stuff, chan Result[string]) {
+		getter := make(chan Stuff)
+		teller := make(chan Result[string])
+		go func() {
+			var results []Result[string]
+			for i := 1; i <= limit; i++ {
+				getter <- Stuff{Msg: "typed", Count: i, TS: time.Now()}
+				result, ok := <-teller
+				if !ok {
+					break
+				}
+				results = append(results, result)
+			}
+			close(getter)
+			done <- results
+		}()
+		return getter, teller
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(TypedPusher[Stuff, string](sender, testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	if err := TypedClient[Stuff, string](ts.URL, fizzbuzz, true, nil, logger); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	results := <-done
+	if len(results) != limit {
+		t.Fatalf("expected %d results but got: %d", limit, len(results))
+	}
+	for i, result := range results {
+		count := i + 1
+		want, _, err := fizzbuzz(Stuff{Count: count})
+		if result.Seq != uint64(count) {
+			t.Errorf("result %d has seq: %d", count, result.Seq)
+		}
+		if result.Value != want {
+			t.Errorf("result %d has value: %q -- expected: %q", count, result.Value, want)
+		}
+		if err != nil && result.ErrMsg != err.Error() {
+			t.Errorf("result %d has error: %q -- expected: %q", count, result.ErrMsg, err)
+		}
+	}
+}
+
+func TestTypedEncodeError(t *testing.T) {
+	done := make(chan Result[string], 1)
+	sender := func() (chan func(), chan Result[string]) {
+		getter := make(chan func())
+		teller := make(chan Result[string])
+		go func() {
+			getter <- func() {}
+			done <- <-teller
+			close(getter)
+		}()
+		return getter, teller
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(TypedPusher[func(), string](sender, testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	if err := badClient(ts.URL, logger, testTimeout/10); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	result := <-done
+	if result.Seq != 0 || result.ErrMsg == "" {
+		t.Fatalf("expected unsent error result but got: %+v", result)
+	}
+	t.Log("got expected error:", result.ErrMsg)
+}
+
+// TestTypedSetupFailure checks that the producer's channel is closed
+// after it reports a failure
+func TestTypedSetupFailure(t *testing.T) {
+	closed := make(chan struct{})
+	sender := func() (chan Stuff, chan Result[string]) {
+		teller := make(chan Result[string])
+		go func() {
+			teller <- Result[string]{ErrMsg: "no stuff today"}
+			for range teller {
+			}
+			close(closed)
+		}()
+		return nil, teller
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(TypedPusher[Stuff, string](sender, testExpires, testPing, nil, logger)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("setup failure answered with: %s", resp.Status)
+	}
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("results channel was not closed")
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"io"
 	"log"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -20,10 +22,42 @@ const (
 	LogFlags = log.Ldate | log.Lmicroseconds | log.Lshortfile
 )
 
+// ErrReplyTimeout is reported in the Results of a push the client did not answer in time
+var ErrReplyTimeout = errors.New("websox: reply timeout")
+
 // Results is used to return client results / errors on websocket pushes
+//
+// Seq is the sequence number of the push being answered, numbered from 1
+// in the order messages were taken from the Setup channel
+//
+// Payload holds the client reply encoded with the connection's Codec,
+// and Span reports the client span that handled the push if tracing is enabled.
+// ID is the message ID of a push kept in an Outbox
 type Results struct {
-	ErrMsg  string           `json:"error"`
-	Payload *json.RawMessage `json:"payload"`
+	ErrMsg  string           `json:"error" proto:"1"`
+	Payload *json.RawMessage `json:"payload" proto:"2"`
+	Seq     uint64           `json:"seq" proto:"3"`
+	Span    *SpanStatus      `json:"span,omitempty" proto:"4"`
+	ID      string           `json:"id,omitempty" proto:"6"`
+
+	codec Codec // the codec Payload was encoded with
+}
+
+// TimedOut reports whether the push went unanswered past the reply timeout
+func (r Results) TimedOut() bool {
+	return r.ErrMsg == ErrReplyTimeout.Error()
+}
+
+// Decode unmarshals the reply payload into v
+func (r Results) Decode(v interface{}) error {
+	if r.Payload == nil {
+		return fmt.Errorf("no payload to decode")
+	}
+	codec := r.codec
+	if codec == nil {
+		codec = JSON
+	}
+	return codec.Unmarshal(*r.Payload, v)
 }
 
 // Stuff is a sample struct for testing
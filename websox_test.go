@@ -1,6 +1,7 @@
 package websox
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -440,3 +443,69 @@ func TestClientBadDial(t *testing.T) {
 		t.Fatal("expected dial error")
 	}
 }
+
+// TestLegacyServer checks that a server negotiating no subprotocol
+// is taken to push bare messages and is only sent Results
+func TestLegacyServer(t *testing.T) {
+	msgs := []string{"one", "two"}
+	replies := make(chan Results, len(msgs))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for _, msg := range msgs {
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+				t.Error(err)
+				return
+			}
+			var results Results
+			if err := conn.ReadJSON(&results); err != nil {
+				t.Error(err)
+				return
+			}
+			replies <- results
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+	defer ts.Close()
+
+	requester := NewRequester()
+	var (
+		ask    sync.Once
+		askErr error
+	)
+	echo := func(r io.Reader) (interface{}, bool, error) {
+		ask.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			_, askErr = requester.Request(ctx, strings.NewReader("ask"))
+		})
+		b, err := io.ReadAll(r)
+		return string(b), true, err
+	}
+	subs := make(chan Subscription, 1)
+	subs <- Subscription{Subscribe: []string{"a.*"}}
+	client := ClientConfig{
+		Codecs:        []Codec{testBinary},
+		Subscriptions: subs,
+		Requester:     requester,
+		Logger:        FromLogger(logger),
+	}
+	if err := client.Client(context.Background(), ts.URL, echo); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if askErr != ErrNoHandler {
+		t.Errorf("request answered with: %v", askErr)
+	}
+	for _, msg := range msgs {
+		results := <-replies
+		var reply string
+		if err := results.Decode(&reply); err != nil || reply != msg {
+			t.Errorf("replied %q (%v) -- expected %q", reply, err, msg)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package websoxbolt keeps websox Outbox messages in a bbolt database file
+package websoxbolt
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/paulstuart/websox"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// outboxBucket holds a bucket of messages for each client key
+var outboxBucket = []byte("websox.outbox")
+
+// Store is a websox.OutboxStore backed by a bbolt database
+//
+// Messages are stored by ID under the client key, with the
+// creation time as an 8 byte Unix nanosecond prefix of the payload
+type Store struct {
+	db *bolt.DB
+}
+
+var _ websox.OutboxStore = (*Store)(nil)
+
+// Open opens or creates the database file at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "outbox open error")
+	}
+	return New(db), nil
+}
+
+// New returns a Store using an open database
+func New(db *bolt.DB) *Store {
+	return &Store{db: db}
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// bucketName is the name of the bucket for key, which may be empty
+func bucketName(key string) []byte {
+	return append([]byte{'k'}, key...)
+}
+
+func (s *Store) Save(key string, msg websox.OutboxMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		outbox, err := tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return err
+		}
+		b, err := outbox.CreateBucketIfNotExists(bucketName(key))
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 8, 8+len(msg.Payload))
+		binary.BigEndian.PutUint64(value, uint64(msg.Created.UnixNano()))
+		return b.Put([]byte(msg.ID), append(value, msg.Payload...))
+	})
+}
+
+func (s *Store) Pending(key string) ([]websox.OutboxMessage, error) {
+	var messages []websox.OutboxMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		b := outbox.Bucket(bucketName(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(id, value []byte) error {
+			if len(value) < 8 {
+				return errors.Errorf("outbox message %s is corrupt", id)
+			}
+			messages = append(messages, websox.OutboxMessage{
+				ID:      string(id),
+				Payload: append([]byte(nil), value[8:]...),
+				Created: time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+			})
+			return nil
+		})
+	})
+	return messages, err
+}
+
+func (s *Store) Delete(key, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		b := outbox.Bucket(bucketName(key))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return outbox.DeleteBucket(bucketName(key))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websoxbolt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulstuart/websox"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now()
+	for _, msg := range []websox.OutboxMessage{
+		{ID: "0003", Payload: []byte("three"), Created: created},
+		{ID: "0001", Payload: []byte("one"), Created: created},
+		{ID: "0002", Payload: []byte("two"), Created: created},
+	} {
+		if err := store.Save("alice", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Save("", websox.OutboxMessage{ID: "0004", Payload: []byte("anyone")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("alice", "0002"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages outlive the process
+	if store, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	pending, err := store.Pending("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != "0001" || pending[1].ID != "0003" {
+		t.Fatalf("pending: %+v", pending)
+	}
+	if string(pending[1].Payload) != "three" || !pending[1].Created.Equal(created) {
+		t.Errorf("message not kept: %+v", pending[1])
+	}
+
+	for _, id := range []string{"0001", "0003", "missing"} {
+		if err := store.Delete("alice", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, _ := store.Pending("alice"); len(pending) != 0 {
+		t.Errorf("pending after delete: %+v", pending)
+	}
+	if pending, _ := store.Pending(""); len(pending) != 1 || string(pending[0].Payload) != "anyone" {
+		t.Errorf("pending for empty key: %+v", pending)
+	}
+}
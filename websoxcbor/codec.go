@@ -0,0 +1,21 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package websoxcbor encodes websox connections with CBOR (RFC 8949)
+package websoxcbor
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/paulstuart/websox"
+)
+
+// Codec encodes with CBOR, honoring json struct tags
+var Codec websox.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string                               { return "websox.cbor" }
+func (codec) Binary() bool                               { return true }
+func (codec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (codec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
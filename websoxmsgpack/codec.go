@@ -0,0 +1,37 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package websoxmsgpack encodes websox connections with MessagePack
+package websoxmsgpack
+
+import (
+	"bytes"
+
+	"github.com/paulstuart/websox"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes with MessagePack, honoring json struct tags
+var Codec websox.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string { return "websox.msgpack" }
+func (codec) Binary() bool { return true }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	enc := msgpack.NewEncoder(&buff)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websoxmsgpack
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/paulstuart/websox"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	raw := json.RawMessage(`"payload"`)
+	in := websox.Results{ErrMsg: "oops", Payload: &raw, Seq: 42, Span: &websox.SpanStatus{TraceID: "t", SpanID: "s", Code: "Ok"}}
+	b, err := Codec.Marshal(in)
+	if err != nil {
+		t.Fatal("encode error:", err)
+	}
+	var out websox.Results
+	if err := Codec.Unmarshal(b, &out); err != nil {
+		t.Fatal("decode error:", err)
+	}
+	if out.ErrMsg != in.ErrMsg || out.Seq != in.Seq || out.Payload == nil || string(*out.Payload) != string(raw) || *out.Span != *in.Span {
+		t.Errorf("results mismatch: %+v", out)
+	}
+}
+
+func TestCodecSession(t *testing.T) {
+	done := make(chan websox.Results, 1)
+	setup := func() (chan io.Reader, chan websox.Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan websox.Results)
+		go func() {
+			getter <- strings.NewReader("hello")
+			done <- <-teller
+			close(getter)
+		}()
+		return getter, teller
+	}
+	cfg := websox.PusherConfig{Codecs: []websox.Codec{Codec}}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	reply := func(r io.Reader) (interface{}, bool, error) {
+		b, err := io.ReadAll(r)
+		return strings.ToUpper(string(b)), true, err
+	}
+	client := websox.ClientConfig{Codecs: []websox.Codec{Codec}}
+	if err := client.Client(context.Background(), ts.URL, reply); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	results := <-done
+	var got string
+	if err := results.Decode(&got); err != nil || got != "HELLO" || results.Seq != 1 {
+		t.Fatalf("unexpected results: %+v %q (%v)", results, got, err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package websoxprom reports websox Pusher activity as Prometheus metrics
+package websoxprom
+
+import (
+	"time"
+
+	"github.com/paulstuart/websox"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a websox.Metrics that is also a prometheus.Collector
+//
+// Register it with a prometheus.Registerer and set it as PusherConfig.Metrics
+type Metrics struct {
+	active   prometheus.Gauge
+	started  prometheus.Counter
+	ended    *prometheus.CounterVec
+	pushed   prometheus.Counter
+	sent     prometheus.Counter
+	received prometheus.Counter
+	replies  *prometheus.CounterVec
+	timeouts prometheus.Counter
+	latency  prometheus.Histogram
+}
+
+var _ websox.Metrics = (*Metrics)(nil)
+
+// New returns Metrics named with the given namespace, e.g., "myapp_websox_sessions_active"
+func New(namespace string) *Metrics {
+	buckets := make([]float64, len(websox.LatencyBuckets))
+	for i, bound := range websox.LatencyBuckets {
+		buckets[i] = bound.Seconds()
+	}
+	opts := func(name, help string) prometheus.Opts {
+		return prometheus.Opts{Namespace: namespace, Subsystem: "websox", Name: name, Help: help}
+	}
+	return &Metrics{
+		active:   prometheus.NewGauge(prometheus.GaugeOpts(opts("sessions_active", "Push sessions in progress."))),
+		started:  prometheus.NewCounter(prometheus.CounterOpts(opts("sessions_started_total", "Push sessions started."))),
+		ended:    prometheus.NewCounterVec(prometheus.CounterOpts(opts("sessions_ended_total", "Push sessions ended, by reason.")), []string{"reason"}),
+		pushed:   prometheus.NewCounter(prometheus.CounterOpts(opts("messages_pushed_total", "Messages pushed to clients."))),
+		sent:     prometheus.NewCounter(prometheus.CounterOpts(opts("sent_bytes_total", "Payload bytes pushed to clients."))),
+		received: prometheus.NewCounter(prometheus.CounterOpts(opts("received_bytes_total", "Reply bytes received from clients."))),
+		replies:  prometheus.NewCounterVec(prometheus.CounterOpts(opts("replies_total", "Client replies, by whether they reported an error.")), []string{"status"}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts(opts("reply_timeouts_total", "Pushes that were not answered in time."))),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "websox",
+			Name:      "reply_latency_seconds",
+			Help:      "Time between a push and the client's reply.",
+			Buckets:   buckets,
+		}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.active, m.started, m.ended, m.pushed, m.sent,
+		m.received, m.replies, m.timeouts, m.latency,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) SessionStarted() {
+	m.active.Inc()
+	m.started.Inc()
+}
+
+func (m *Metrics) SessionEnded(reason string) {
+	m.active.Dec()
+	m.ended.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) Pushed(bytes int64) {
+	m.pushed.Inc()
+	m.sent.Add(float64(bytes))
+}
+
+func (m *Metrics) Received(bytes int) {
+	m.received.Add(float64(bytes))
+}
+
+func (m *Metrics) Replied(latency time.Duration, failed bool) {
+	status := "ok"
+	if failed {
+		status = "error"
+	}
+	m.replies.WithLabelValues(status).Inc()
+	m.latency.Observe(latency.Seconds())
+}
+
+func (m *Metrics) TimedOut() {
+	m.timeouts.Inc()
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websoxprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulstuart/websox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New("test")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+
+	m.SessionStarted()
+	m.Pushed(100)
+	m.Received(10)
+	m.Replied(time.Millisecond*3, false)
+	m.Replied(time.Millisecond*30, true)
+	m.TimedOut()
+	m.SessionEnded(websox.EndExpired)
+
+	if got := testutil.ToFloat64(m.active); got != 0 {
+		t.Errorf("active sessions: %v", got)
+	}
+	if got := testutil.ToFloat64(m.ended.WithLabelValues(websox.EndExpired)); got != 1 {
+		t.Errorf("expired sessions: %v", got)
+	}
+	if got := testutil.ToFloat64(m.sent); got != 100 {
+		t.Errorf("bytes sent: %v", got)
+	}
+	if got := testutil.ToFloat64(m.replies.WithLabelValues("error")); got != 1 {
+		t.Errorf("failed replies: %v", got)
+	}
+	if count := testutil.CollectAndCount(m); count != 10 {
+		t.Errorf("collected %d metrics", count)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package websoxproto encodes websox connections with protocol buffers
+package websoxproto
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/paulstuart/websox"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes proto.Message values with protocol buffers
+//
+// The websox wire types are encoded as messages numbered by their proto
+// struct tags, so no generated code is needed. Fields of embedded structs
+// without a tag belong to the outer message
+var Codec websox.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string { return "websox.proto" }
+func (codec) Binary() bool { return true }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct && len(fieldsOf(rv.Type())) > 0 {
+		return appendMessage(nil, rv)
+	}
+	return nil, fmt.Errorf("protobuf codec cannot encode %T", v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() && rv.Elem().Kind() == reflect.Struct && len(fieldsOf(rv.Elem().Type())) > 0 {
+		return consumeMessage(data, rv.Elem())
+	}
+	return fmt.Errorf("protobuf codec cannot decode %T", v)
+}
+
+// field is a numbered field of a struct, by its index for FieldByIndex
+type field struct {
+	num   protowire.Number
+	index []int
+}
+
+// fields caches the numbered fields of each struct type
+var fields sync.Map
+
+// fieldsOf returns the fields of t with a proto tag
+func fieldsOf(t reflect.Type) []field {
+	if cached, ok := fields.Load(t); ok {
+		return cached.([]field)
+	}
+	var list []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("proto")
+		switch {
+		case !ok && sf.Anonymous && sf.Type.Kind() == reflect.Struct:
+			for _, f := range fieldsOf(sf.Type) {
+				list = append(list, field{f.num, append([]int{i}, f.index...)})
+			}
+		case ok:
+			num, err := strconv.Atoi(tag)
+			if err != nil || num < 1 {
+				panic(fmt.Sprintf("websoxproto: bad field number %q for %s.%s", tag, t, sf.Name))
+			}
+			list = append(list, field{protowire.Number(num), []int{i}})
+		}
+	}
+	fields.Store(t, list)
+	return list
+}
+
+// isBytes reports whether t is a byte slice, such as json.RawMessage
+func isBytes(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+// appendMessage appends the numbered fields of struct v to b,
+// leaving out zero scalars and nil pointers, slices and maps
+func appendMessage(b []byte, v reflect.Value) ([]byte, error) {
+	for _, f := range fieldsOf(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		switch {
+		case fv.Kind() == reflect.Uint64:
+			if fv.Uint() != 0 {
+				b = protowire.AppendTag(b, f.num, protowire.VarintType)
+				b = protowire.AppendVarint(b, fv.Uint())
+			}
+		case fv.Kind() == reflect.String:
+			if fv.Len() > 0 {
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendString(b, fv.String())
+			}
+		case isBytes(fv.Type()):
+			if !fv.IsNil() {
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendBytes(b, fv.Bytes())
+			}
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+			for i := 0; i < fv.Len(); i++ {
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendString(b, fv.Index(i).String())
+			}
+		case fv.Kind() == reflect.Map && fv.Type().Key().Kind() == reflect.String && fv.Type().Elem().Kind() == reflect.String:
+			iter := fv.MapRange()
+			for iter.Next() {
+				// map entries are messages with the key as field 1 and value as field 2
+				var entry []byte
+				entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+				entry = protowire.AppendString(entry, iter.Key().String())
+				entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+				entry = protowire.AppendString(entry, iter.Value().String())
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendBytes(b, entry)
+			}
+		case fv.Kind() == reflect.Pointer && isBytes(fv.Type().Elem()):
+			if !fv.IsNil() {
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendBytes(b, fv.Elem().Bytes())
+			}
+		case fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct:
+			if !fv.IsNil() {
+				m, err := appendMessage(nil, fv.Elem())
+				if err != nil {
+					return nil, err
+				}
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendBytes(b, m)
+			}
+		default:
+			return nil, fmt.Errorf("protobuf codec cannot encode field %d of type %s", f.num, fv.Type())
+		}
+	}
+	return b, nil
+}
+
+// consumeMessage decodes the fields of a message into struct v,
+// skipping unknown fields
+func consumeMessage(data []byte, v reflect.Value) error {
+	list := fieldsOf(v.Type())
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n = 0
+		for _, f := range list {
+			if f.num == num {
+				var err error
+				if n, err = consumeField(data, typ, v.FieldByIndex(f.index)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// consumeField decodes one field value into fv, returning its length,
+// or 0 if the wire type does not match the field
+func consumeField(data []byte, typ protowire.Type, fv reflect.Value) (int, error) {
+	if fv.Kind() == reflect.Uint64 {
+		if typ != protowire.VarintType {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeVarint(data)
+		fv.SetUint(v)
+		return n, nil
+	}
+	if typ != protowire.BytesType {
+		return 0, nil
+	}
+	b, n := protowire.ConsumeBytes(data)
+	if n < 0 {
+		return n, nil
+	}
+	switch {
+	case fv.Kind() == reflect.String:
+		fv.SetString(string(b))
+	case isBytes(fv.Type()):
+		fv.SetBytes(append([]byte{}, b...))
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+		fv.Set(reflect.Append(fv, reflect.ValueOf(string(b)).Convert(fv.Type().Elem())))
+	case fv.Kind() == reflect.Map:
+		var entry struct {
+			Key   string `proto:"1"`
+			Value string `proto:"2"`
+		}
+		if err := consumeMessage(b, reflect.ValueOf(&entry).Elem()); err != nil {
+			return n, err
+		}
+		if fv.IsNil() {
+			fv.Set(reflect.MakeMap(fv.Type()))
+		}
+		fv.SetMapIndex(reflect.ValueOf(entry.Key), reflect.ValueOf(entry.Value))
+	case fv.Kind() == reflect.Pointer:
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		if elem := fv.Elem(); isBytes(elem.Type()) {
+			elem.SetBytes(append([]byte{}, b...))
+		} else {
+			return n, consumeMessage(b, elem)
+		}
+	default:
+		return 0, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websoxproto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/paulstuart/websox"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// frame mirrors the shape of the websox wire types
+type frame struct {
+	websox.Results
+	Trace        map[string]string    `proto:"7"`
+	Subscription *websox.Subscription `proto:"5"`
+	Body         []byte               `proto:"8"`
+	Offset       uint64               `proto:"9"`
+
+	skipped string
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	raw := json.RawMessage(`"payload"`)
+	in := frame{
+		Results: websox.Results{
+			ErrMsg:  "oops",
+			Payload: &raw,
+			Seq:     42,
+			Span:    &websox.SpanStatus{TraceID: "t", SpanID: "s", Code: "Ok"},
+			ID:      "0001",
+		},
+		Trace:        map[string]string{"traceparent": "00-01", "tracestate": "a=b"},
+		Subscription: &websox.Subscription{Subscribe: []string{"a.*", "b.>"}, Unsubscribe: []string{"c"}},
+		Body:         []byte("ask"),
+		Offset:       12,
+		skipped:      "not sent",
+	}
+	b, err := Codec.Marshal(in)
+	if err != nil {
+		t.Fatal("encode error:", err)
+	}
+	var out frame
+	if err := Codec.Unmarshal(b, &out); err != nil {
+		t.Fatal("decode error:", err)
+	}
+	in.skipped = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("frame mismatch: %+v -- expected %+v", out, in)
+	}
+
+	// Results keep the field numbers of the message
+	b, err = Codec.Marshal(websox.Results{ErrMsg: "oops", Seq: 3})
+	if err != nil {
+		t.Fatal("encode error:", err)
+	}
+	if want := []byte{0x0a, 4, 'o', 'o', 'p', 's', 0x18, 3}; !bytes.Equal(b, want) {
+		t.Errorf("results encoded as %x -- expected %x", b, want)
+	}
+
+	if _, err := Codec.Marshal("text"); err == nil {
+		t.Error("encoded a string")
+	}
+}
+
+func TestCodecSession(t *testing.T) {
+	done := make(chan websox.Results, 1)
+	setup := func() (chan io.Reader, chan websox.Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan websox.Results)
+		go func() {
+			getter <- strings.NewReader("hello")
+			done <- <-teller
+			close(getter)
+		}()
+		return getter, teller
+	}
+	cfg := websox.PusherConfig{Codecs: []websox.Codec{Codec}}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	reply := func(r io.Reader) (interface{}, bool, error) {
+		b, err := io.ReadAll(r)
+		return wrapperspb.String(strings.ToUpper(string(b))), true, err
+	}
+	client := websox.ClientConfig{Codecs: []websox.Codec{Codec}}
+	if err := client.Client(context.Background(), ts.URL, reply); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	results := <-done
+	var msg wrapperspb.StringValue
+	if err := results.Decode(&msg); err != nil || msg.GetValue() != "HELLO" || results.Seq != 1 {
+		t.Fatalf("unexpected results: %+v %q (%v)", results, msg.GetValue(), err)
+	}
+}
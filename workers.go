@@ -0,0 +1,135 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// Ordering is the order a Client with Workers handles messages in
+type Ordering int
+
+const (
+	// OrderNone hands each message to the next free worker
+	OrderNone Ordering = iota
+
+	// OrderByKey handles messages with the same key one at a time,
+	// in the order they were received
+	OrderByKey
+
+	// OrderStrict handles messages one at a time, in the order they
+	// were received, while the next messages are read ahead
+	OrderStrict
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case OrderNone:
+		return "none"
+	case OrderByKey:
+		return "key"
+	case OrderStrict:
+		return "strict"
+	}
+	return "unknown"
+}
+
+// job is a message waiting on a worker
+type job struct {
+	env  envelope
+	body []byte
+}
+
+// reader returns the message as given to the Actionable
+func (j job) reader() io.Reader {
+	return contextReader{Reader: bytes.NewReader(j.body), topic: j.env.Topic, id: j.env.ID}
+}
+
+// workers run the Actionable for the messages of a connection
+//
+// Unordered messages share a single queue, otherwise each worker has
+// its own queue and messages with the same key go to the same worker
+type workers struct {
+	queues   []chan job
+	key      func(io.Reader) string
+	recovery Recovery
+	logger   *slog.Logger
+	wg       sync.WaitGroup
+}
+
+// startWorkers starts the workers configured by cfg, handling each message with handle
+func startWorkers(cfg ClientConfig, handle func(job)) *workers {
+	size := cfg.Queue
+	if size < 1 {
+		size = cfg.Workers
+	}
+	w := &workers{key: cfg.Key, recovery: cfg.Recovery, logger: cfg.Logger}
+	if w.key == nil {
+		w.key = ReaderTopic
+	}
+
+	run := func(q <-chan job) {
+		defer w.wg.Done()
+		for j := range q {
+			handle(j)
+		}
+	}
+
+	switch cfg.Ordering {
+	case OrderStrict:
+		w.queues = []chan job{make(chan job, size)}
+		w.wg.Add(1)
+		go run(w.queues[0])
+	case OrderByKey:
+		size = max(size/cfg.Workers, 1)
+		for i := 0; i < cfg.Workers; i++ {
+			q := make(chan job, size)
+			w.queues = append(w.queues, q)
+			w.wg.Add(1)
+			go run(q)
+		}
+	default:
+		w.queues = []chan job{make(chan job, size)}
+		for i := 0; i < cfg.Workers; i++ {
+			w.wg.Add(1)
+			go run(w.queues[0])
+		}
+	}
+	return w
+}
+
+// queue waits until there is room for j, or ctx is done
+func (w *workers) queue(ctx context.Context, j job) error {
+	q := w.queues[0]
+	if len(w.queues) > 1 {
+		// a message whose key panics is ordered with those without a key
+		var key string
+		w.recovery.catch("Key", w.logger, func() {
+			key = w.key(j.reader())
+		})
+		h := fnv.New32a()
+		io.WriteString(h, key)
+		q = w.queues[h.Sum32()%uint32(len(w.queues))]
+	}
+	select {
+	case q <- j:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop waits for the queued messages to be handled
+func (w *workers) stop() {
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushAll pushes msgs to a client running fn with cfg, returning the Results by Seq
+func pushAll(t *testing.T, msgs []string, client ClientConfig, fn Actionable) map[uint64]Results {
+	t.Helper()
+	all := make(chan map[uint64]Results, 1)
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			for _, msg := range msgs {
+				getter <- strings.NewReader(`"` + msg + `"`)
+			}
+			close(getter)
+			got := make(map[uint64]Results)
+			for results := range teller {
+				got[results.Seq] = results
+			}
+			all <- got
+		}()
+		return getter, teller
+	}
+	cfg := PusherConfig{
+		Window:   len(msgs),
+		PingFreq: testPing,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	client.Logger = FromLogger(logger)
+	if err := client.Client(context.Background(), ts.URL, fn); err != nil {
+		t.Fatal(err)
+	}
+	return <-all
+}
+
+// decoded returns the message an Actionable was given
+func decoded(t *testing.T, r io.Reader) string {
+	var msg string
+	if err := json.NewDecoder(r).Decode(&msg); err != nil {
+		t.Error(err)
+	}
+	return msg
+}
+
+func TestWorkers(t *testing.T) {
+	const workers = 4
+
+	// every message waits until all of them are being handled
+	var started sync.WaitGroup
+	started.Add(workers)
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+	action := func(r io.Reader) (interface{}, bool, error) {
+		msg := decoded(t, r)
+		started.Done()
+		select {
+		case <-all:
+		case <-time.After(testTimeout):
+			t.Error("messages not handled concurrently")
+		}
+		if msg == "boom" {
+			panic("boom")
+		}
+		return msg, true, nil
+	}
+
+	msgs := []string{"a", "b", "boom", "d"}
+	got := pushAll(t, msgs, ClientConfig{Workers: workers}, action)
+	if len(got) != len(msgs) {
+		t.Fatalf("got %d results -- expected %d", len(got), len(msgs))
+	}
+	for seq, results := range got {
+		msg := msgs[seq-1]
+		if msg == "boom" {
+			if !strings.Contains(results.ErrMsg, "panic in Actionable: boom") {
+				t.Errorf("panic answered with: %+v", results)
+			}
+			continue
+		}
+		var reply string
+		if err := results.Decode(&reply); err != nil || reply != msg {
+			t.Errorf("message %s answered with %q (%v)", msg, reply, err)
+		}
+	}
+}
+
+func TestWorkerOrdering(t *testing.T) {
+	msgs := []string{"a1", "b1", "a2", "c1", "b2", "a3", "c2", "b3", "a4", "c3"}
+	for _, ordering := range []Ordering{OrderStrict, OrderByKey} {
+		var (
+			mu      sync.Mutex
+			handled []string
+		)
+		action := func(r io.Reader) (interface{}, bool, error) {
+			msg := decoded(t, r)
+			time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			mu.Lock()
+			handled = append(handled, msg)
+			mu.Unlock()
+			return nil, true, nil
+		}
+		cfg := ClientConfig{
+			Workers:  3,
+			Queue:    6,
+			Ordering: ordering,
+			Key: func(r io.Reader) string {
+				if ReaderContext(r) == nil {
+					t.Error("key reader has a nil context")
+				}
+				return decoded(t, r)[:1]
+			},
+		}
+		if got := pushAll(t, msgs, cfg, action); len(got) != len(msgs) {
+			t.Fatalf("%s: got %d results -- expected %d", ordering, len(got), len(msgs))
+		}
+
+		if ordering == OrderStrict {
+			if strings.Join(handled, " ") != strings.Join(msgs, " ") {
+				t.Errorf("strict ordering handled: %q", handled)
+			}
+			continue
+		}
+		last := make(map[byte]byte)
+		for _, msg := range handled {
+			if msg[1] < last[msg[0]] {
+				t.Errorf("key ordering handled: %q", handled)
+				break
+			}
+			last[msg[0]] = msg[1]
+		}
+	}
+}
+
+// TestWorkersStop checks that reading stops once an Actionable is done
+func TestWorkersStop(t *testing.T) {
+	action := func(r io.Reader) (interface{}, bool, error) {
+		msg := decoded(t, r)
+		return msg, msg != "stop", nil
+	}
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			// the producer never finishes
+			for {
+				getter <- strings.NewReader(`"stop"`)
+				if _, ok := <-teller; !ok {
+					return
+				}
+			}
+		}()
+		return getter, teller
+	}
+	cfg := PusherConfig{PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		client := ClientConfig{Workers: 2, Logger: FromLogger(logger)}
+		done <- client.Client(context.Background(), ts.URL, action)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("client did not stop")
+	}
+}
+
+// TestReconnectWorkers checks that workers deciding to stop end a Reconnect
+func TestReconnectWorkers(t *testing.T) {
+	const workers = 4
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader)
+		teller := make(chan Results)
+		go func() {
+			for {
+				select {
+				case getter <- strings.NewReader(`"stop"`):
+				case _, ok := <-teller:
+					if !ok {
+						return
+					}
+				}
+			}
+		}()
+		return getter, teller
+	}
+	cfg := PusherConfig{Window: workers, PingFreq: testPing, Logger: FromLogger(logger)}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	// every worker is handling a message when they stop
+	var started sync.WaitGroup
+	started.Add(workers)
+	action := func(r io.Reader) (interface{}, bool, error) {
+		started.Done()
+		started.Wait()
+		return decoded(t, r), false, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		client := ClientConfig{Workers: workers, Queue: workers, Logger: FromLogger(logger)}
+		policy := ReconnectPolicy{Initial: time.Millisecond}
+		done <- client.Reconnect(context.Background(), ts.URL, action, nil, policy)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("client did not stop")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// outbound is a frame queued for the writer
+type outbound struct {
+	env  envelope
+	body io.Reader
+}
+
+// sentFrame reports how an outbound frame went
+type sentFrame struct {
+	env envelope
+	n   int64 // the payload size sent
+	err error
+}
+
+// writer is the only goroutine writing data frames to a session's connection,
+// so the listener can queue frames without waiting on a slow client
+//
+// Control frames may still be written at any time with WriteControl,
+// which is safe alongside the writer
+type writer struct {
+	conn      *websocket.Conn
+	codec     Codec
+	threshold int
+
+	in   chan outbound
+	out  chan sentFrame
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startWriter starts writing the frames sent on its in channel,
+// reporting each one on its out channel
+func startWriter(conn *websocket.Conn, codec Codec, threshold int) *writer {
+	w := &writer{
+		conn:      conn,
+		codec:     codec,
+		threshold: threshold,
+		in:        make(chan outbound),
+		out:       make(chan sentFrame),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+	for {
+		select {
+		case f := <-w.in:
+			n, err := writeFrame(w.conn, w.codec, w.threshold, f.env, f.body)
+			select {
+			case w.out <- sentFrame{env: f.env, n: n, err: err}:
+			case <-w.quit:
+				return
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// stop ends the writer once the frame being written is done,
+// giving up on a client that is too slow to take it
+func (w *writer) stop() {
+	close(w.quit)
+	select {
+	case <-w.done:
+	case <-time.After(writeWait):
+		// failing the write ends it
+		w.conn.UnderlyingConn().Close()
+		<-w.done
+	}
+}
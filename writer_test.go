@@ -0,0 +1,112 @@
+// Copyright 2017 Paul Stuart
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websox
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriter(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: subprotocols(nil)}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer ts.Close()
+
+	client, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	w := startWriter(conn, JSON, 0)
+	msgs := []string{"one", "two", "three"}
+	go func() {
+		for i, msg := range msgs {
+			w.in <- outbound{env: envelope{Seq: uint64(i + 1)}, body: strings.NewReader(msg)}
+		}
+	}()
+	for i, msg := range msgs {
+		sent := <-w.out
+		if sent.err != nil || sent.env.Seq != uint64(i+1) || sent.n != int64(len(msg)) {
+			t.Errorf("frame %d reported as %+v", i+1, sent)
+		}
+		_, r, err := client.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, body, err := readFrame(JSON, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(body); env.Seq != uint64(i+1) || string(b) != msg {
+			t.Errorf("frame %d received as %d: %q", i+1, env.Seq, b)
+		}
+	}
+	w.stop()
+
+	// control frames go out alongside the writer
+	if err := ping(conn); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestWriterShutdown checks that a session stuck writing to a client
+// that stopped reading still ends on shutdown
+func TestWriterShutdown(t *testing.T) {
+	shutdown, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	metrics := endings{ended: make(chan string, 1)}
+	setup := func() (chan io.Reader, chan Results) {
+		getter := make(chan io.Reader, 1)
+		teller := make(chan Results)
+		// far more than the connection buffers
+		getter <- bytes.NewReader(make([]byte, 64<<20))
+		return getter, teller
+	}
+	cfg := PusherConfig{
+		Shutdown: shutdown,
+		PingFreq: time.Millisecond * 10,
+		Metrics:  metrics,
+		Logger:   FromLogger(logger),
+	}
+	ts := httptest.NewServer(cfg.Pusher(setup))
+	defer ts.Close()
+
+	conn, err := dial(ts.URL, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// let the push get stuck before shutting down
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	select {
+	case reason := <-metrics.ended:
+		if reason != EndCancelled {
+			t.Errorf("session ended with: %q", reason)
+		}
+	case <-time.After(writeWait * 3):
+		t.Fatal("session did not end")
+	}
+}